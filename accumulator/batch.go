@@ -19,6 +19,7 @@ package accumulator
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"sync"
@@ -53,10 +54,13 @@ var (
 // data it marks the data ready for shipping to APM Server.
 type Batch struct {
 	mu sync.RWMutex
-	// metadataBytes is the size of the metadata in bytes
-	metadataBytes int
-	// buf holds data that is ready to be shipped to APM-Server
-	buf bytes.Buffer
+	// streams holds the data that is ready to be shipped to APM Server,
+	// split by distinct metadata in the order the metadata was received.
+	// Lambda data and proxy transactions go to the first stream.
+	streams []*metadataStream
+	// streamsByMetadata indexes the streams by the metadata line as
+	// received from the agents.
+	streamsByMetadata map[string]*metadataStream
 	// invocations holds the data for a specific invocation with
 	// request ID as the key.
 	invocations map[string]*Invocation
@@ -64,22 +68,98 @@ type Batch struct {
 	age         time.Time
 	maxSize     int
 	maxAge      time.Duration
+	// maxBytes limits the uncompressed size of the data shipped in a
+	// single request, maxEventBytes the size of a single event.
+	maxBytes        int
+	maxEventBytes   int
+	oversizedPolicy OversizedEventPolicy
+	// compress enables gzip compression, at compressionLevel, of the
+	// data as it is added to the batch.
+	compress         bool
+	compressionLevel int
 	// currentlyExecutingRequestID represents the request ID of the currently
 	// executing lambda invocation. The ID can be set either on agent init or
 	// when extension receives the invoke event. If the agent hooks into the
 	// invoke lifecycle then it is possible to receive the agent init request
 	// before extension invoke is registered.
 	currentlyExecutingRequestID string
+	// rules, if set, are applied to the agent events.
+	rules *spanRules
+	// compression, if set, compresses the spans of the agents.
+	compression *SpanCompression
+	// txnMetrics, if set, aggregates the transactions of the agents.
+	txnMetrics *txnAggregator
+	// redactor, if set, masks sensitive data in the agent events and
+	// the proxy transactions.
+	redactor *Redactor
+	// overrides, if set, are applied to the metadata.
+	overrides *MetadataOverrides
+	// function, if set, fills in the metadata and faas fields.
+	function *FunctionInfo
+}
+
+// metadataStream holds the events that share the same metadata. Each
+// stream is shipped to APM Server in its own intake request, or in several
+// if its data exceeds the maximum size of a request.
+type metadataStream struct {
+	// key is the metadata line as received from the agent.
+	key string
+	// metadata is the metadata line the stream starts with.
+	metadata []byte
+	buf      bytes.Buffer
+	// gw compresses the data as it is added to the stream, it is nil
+	// if compression is disabled.
+	gw    *gzip.Writer
+	count int
+	// size is the uncompressed size of the stream in bytes.
+	size int
+	// sealed holds the requests of the stream that reached the maximum
+	// size of a request, the stream continues in a new one.
+	sealed []BatchData
+}
+
+// BatchData is the data of a batch for one distinct metadata.
+type BatchData struct {
+	APMData
+	// Count is the number of events, excluding the metadata.
+	Count int
+}
+
+// BatchOption is used to configure a Batch.
+type BatchOption func(*Batch)
+
+// WithCompression enables gzip compression of the data, at the given
+// level, as it is added to the batch. APMData returned by a compressed
+// batch is gzip encoded.
+func WithCompression(level int) BatchOption {
+	return func(b *Batch) {
+		b.compress, b.compressionLevel = true, level
+	}
 }
 
 // NewBatch creates a new BatchData which can accept a
-// maximum number of entries as specified by the arguments.
-func NewBatch(maxSize int, maxAge time.Duration) *Batch {
-	return &Batch{
-		invocations: make(map[string]*Invocation),
-		maxSize:     maxSize,
-		maxAge:      maxAge,
+// maximum number of entries as specified by the arguments. The default
+// limits are used for non-positive arguments.
+func NewBatch(maxSize int, maxAge time.Duration, opts ...BatchOption) *Batch {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	b := &Batch{
+		invocations:       make(map[string]*Invocation),
+		streamsByMetadata: make(map[string]*metadataStream),
+		maxSize:           maxSize,
+		maxAge:            maxAge,
+		maxBytes:          DefaultMaxBytes,
+		maxEventBytes:     DefaultMaxEventBytes,
+		oversizedPolicy:   TruncateOversized,
+	}
+	for _, opt := range opts {
+		opt(b)
 	}
+	return b
 }
 
 // RegisterInvocation registers a new function invocation against its request
@@ -129,7 +209,11 @@ func (b *Batch) OnAgentInit(reqID, txnID string, payload []byte) error {
 // agent data is always received in the same invocation. All the events
 // extracted from the payload are added to the batch even though the batch
 // might exceed the max size limit, however, if the batch is already full
-// before adding any events then ErrBatchFull is returned.
+// before adding any events then ErrBatchFull is returned. The events are
+// added to the stream of the metadata they are received with, which
+// continues in a new request once it reaches the maximum request size.
+// Events that exceed the maximum event size are dropped, reported by a
+// TooLargeError, unless they can be truncated.
 func (b *Batch) AddAgentData(apmData APMData) error {
 	if len(apmData.Data) == 0 {
 		return nil
@@ -155,8 +239,25 @@ func (b *Batch) AddAgentData(apmData APMData) error {
 	// A request body can either be empty or have a ndjson content with
 	// first line being metadata.
 	data, after, _ := bytes.Cut(raw, newLineSep)
-	if b.metadataBytes == 0 {
-		b.metadataBytes, _ = b.buf.Write(data)
+	s, err := b.agentStream(data)
+	if err != nil {
+		return err
+	}
+	if b.rules != nil {
+		b.rules.prepare(after)
+	}
+	var compressor *spanCompressor
+	if b.compression != nil {
+		compressor = newSpanCompressor(b.compression)
+	}
+	var tooLarge int
+	add := func(data []byte) error {
+		if err := b.addData(s, data); errors.Is(err, ErrEventTooLarge) {
+			tooLarge++
+		} else if err != nil {
+			return err
+		}
+		return nil
 	}
 	for {
 		data, after, _ = bytes.Cut(after, newLineSep)
@@ -166,13 +267,41 @@ func (b *Batch) AddAgentData(apmData APMData) error {
 				inc.TransactionObserved = true
 			}
 		}
-		if err := b.addData(data); err != nil {
-			return err
+		if b.txnMetrics != nil && isTransactionEvent(data) && !b.txnMetrics.aggregate(s.key, data) {
+			data = nil
+		}
+		if b.rules != nil {
+			var keep bool
+			if data, keep = b.rules.apply(data); !keep {
+				data = nil
+			}
+		}
+		if b.redactor != nil && len(data) > 0 {
+			data = b.redactor.Redact(data)
+		}
+		events := [][]byte{data}
+		if compressor != nil {
+			events = compressor.add(data)
+		}
+		for _, event := range events {
+			if err := add(event); err != nil {
+				return err
+			}
 		}
 		if len(after) == 0 {
 			break
 		}
 	}
+	if compressor != nil {
+		for _, event := range compressor.flush() {
+			if err := add(event); err != nil {
+				return err
+			}
+		}
+	}
+	if tooLarge > 0 {
+		return &TooLargeError{Dropped: tooLarge}
+	}
 	return nil
 }
 
@@ -202,18 +331,28 @@ func (b *Batch) OnShutdown(status string) error {
 			return err
 		}
 	}
-	return nil
+	return b.addTransactionMetrics(true)
+}
+
+// AddTransactionMetrics adds the aggregated transaction metrics to the
+// batch once the aggregation interval has elapsed. It does nothing unless
+// enabled with WithTransactionMetrics.
+func (b *Batch) AddTransactionMetrics() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addTransactionMetrics(false)
 }
 
-// AddLambdaData adds a new entry to the batch. Returns ErrBatchFull
-// if batch has reached its maximum size.
+// AddLambdaData adds a new entry to the batch, with the metadata first
+// received from the agents. Returns ErrBatchFull if batch has reached its
+// maximum size.
 func (b *Batch) AddLambdaData(d []byte) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if b.count >= b.maxSize {
 		return ErrBatchFull
 	}
-	return b.addData(d)
+	return b.addData(b.primaryStream(), d)
 }
 
 // Count return the number of APMData entries in batch.
@@ -223,33 +362,92 @@ func (b *Batch) Count() int {
 	return b.count
 }
 
+// Age returns the time elapsed since the first entry was added to the
+// batch, or zero if the batch is empty.
+func (b *Batch) Age() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.age.IsZero() {
+		return 0
+	}
+	return time.Since(b.age)
+}
+
+// PendingInvocations returns the number of invocations that have not
+// been finalized yet.
+func (b *Batch) PendingInvocations() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.invocations)
+}
+
+// CurrentInvocation returns a copy of the invocation that is currently
+// executing, if it has not been finalized yet.
+func (b *Batch) CurrentInvocation() (Invocation, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	i, ok := b.invocations[b.currentlyExecutingRequestID]
+	if !ok {
+		return Invocation{}, false
+	}
+	return *i, true
+}
+
 // ShouldShip indicates when a batch is ready for sending.
 // A batch is marked as ready for flush when one of the
 // below conditions is reached:
 // 1. max size is greater than threshold (90% of maxSize)
-// 2. batch is older than maturity age
+// 2. the data of a metadata is greater than threshold (90% of maxBytes)
+// 3. batch is older than maturity age
 func (b *Batch) ShouldShip() bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return (b.count >= int(float64(b.maxSize)*maxSizeThreshold)) ||
-		(!b.age.IsZero() && time.Since(b.age) > b.maxAge)
+	if b.count >= int(float64(b.maxSize)*maxSizeThreshold) {
+		return true
+	}
+	for _, s := range b.streams {
+		if len(s.sealed) > 0 {
+			return true
+		}
+		if s.count > 0 && s.size >= int(float64(b.maxBytes)*maxSizeThreshold) {
+			return true
+		}
+	}
+	return !b.age.IsZero() && time.Since(b.age) > b.maxAge
 }
 
-// Reset resets the batch to prepare for new set of data
+// Reset resets the batch to prepare for new set of data. The metadata
+// first received is kept for the lambda data, the streams of the other
+// metadata are dropped until their agents send data again.
 func (b *Batch) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.count, b.age = 0, zeroTime
-	b.buf.Truncate(b.metadataBytes)
+	if len(b.streams) == 0 {
+		return
+	}
+	primary := b.streams[0]
+	for _, s := range b.streams[1:] {
+		delete(b.streamsByMetadata, s.key)
+	}
+	b.streams = b.streams[:1]
+	primary.reset()
 }
 
-// ToAPMData returns APMData with metadata and the accumulated batch
-func (b *Batch) ToAPMData() APMData {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return APMData{
-		Data: b.buf.Bytes(),
+// ToAPMData returns, for each distinct metadata, APMData with the metadata
+// and the accumulated events, split in several if they exceed the maximum
+// size of a request. Each must be shipped in its own request.
+// For a compressed batch the compressed streams are completed, the batch
+// must be reset before adding more data.
+func (b *Batch) ToAPMData() []BatchData {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := make([]BatchData, 0, len(b.streams))
+	for _, s := range b.streams {
+		data = append(data, s.sealed...)
+		data = append(data, BatchData{APMData: s.toAPMData(), Count: s.count})
 	}
+	return data
 }
 
 func (b *Batch) finalizeInvocation(reqID, status string, time time.Time) error {
@@ -262,20 +460,69 @@ func (b *Batch) finalizeInvocation(reqID, status string, time time.Time) error {
 	if err != nil {
 		return err
 	}
-	return b.addData(proxyTxn)
+	if b.redactor != nil && len(proxyTxn) > 0 {
+		proxyTxn = b.redactor.Redact(proxyTxn)
+	}
+	return b.addData(b.primaryStream(), proxyTxn)
 }
 
-func (b *Batch) addData(data []byte) error {
+// addTransactionMetrics adds the aggregated transaction metrics, each to
+// the stream of the metadata the transactions were received with. The
+// metricsets that can't be added are dropped and reported.
+func (b *Batch) addTransactionMetrics(force bool) error {
+	if b.txnMetrics == nil || !(force || b.txnMetrics.due()) {
+		return nil
+	}
+	var (
+		dropped  int
+		firstErr error
+	)
+	timestamp := time.Now()
+	for _, group := range b.txnMetrics.groups {
+		// The stream might have been dropped when the batch was reset.
+		s, err := b.agentStream([]byte(group.metadata))
+		var metricset []byte
+		if err == nil {
+			metricset, err = b.txnMetrics.metricset(group, timestamp)
+		}
+		if err == nil {
+			err = b.addData(s, metricset)
+		}
+		if err != nil {
+			dropped++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	b.txnMetrics.reset()
+	if firstErr != nil {
+		return fmt.Errorf("%d transaction metricsets dropped: %w", dropped, firstErr)
+	}
+	return nil
+}
+
+func (b *Batch) addData(s *metadataStream, data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
-	if b.metadataBytes == 0 {
+	if s == nil {
 		return ErrMetadataUnavailable
 	}
-	if err := b.buf.WriteByte('\n'); err != nil {
+	if b.function != nil {
+		data = b.function.fillFAAS(data)
+	}
+	data, ok := b.fitEvent(data)
+	if !ok {
+		return ErrEventTooLarge
+	}
+	if b.maxBytes > 0 && s.count > 0 && s.size+len(newLineSep)+len(data) > b.maxBytes {
+		s.seal()
+	}
+	if err := s.write(newLineSep); err != nil {
 		return err
 	}
-	if _, err := b.buf.Write(data); err != nil {
+	if err := s.write(data); err != nil {
 		return err
 	}
 	if b.count == 0 {
@@ -283,10 +530,116 @@ func (b *Batch) addData(data []byte) error {
 		b.age = time.Now()
 	}
 	b.count++
+	s.count++
 	return nil
 }
 
+// primaryStream returns the stream of the metadata first received, or
+// nil if no metadata was received yet.
+func (b *Batch) primaryStream() *metadataStream {
+	if len(b.streams) == 0 {
+		return nil
+	}
+	return b.streams[0]
+}
+
+// agentStream returns the stream for the metadata received from an agent,
+// starting a new one if the metadata was not seen before.
+func (b *Batch) agentStream(metadata []byte) (*metadataStream, error) {
+	if s, ok := b.streamsByMetadata[string(metadata)]; ok {
+		return s, nil
+	}
+	key := string(metadata)
+	if b.redactor != nil {
+		metadata = b.redactor.Redact(metadata)
+	}
+	var err error
+	if b.function != nil {
+		if metadata, err = b.function.apply(metadata); err != nil {
+			return nil, err
+		}
+	}
+	if b.overrides != nil {
+		if metadata, err = b.overrides.apply(metadata); err != nil {
+			return nil, err
+		}
+	}
+	s := &metadataStream{key: key, metadata: metadata}
+	if b.compress {
+		if s.gw, err = gzip.NewWriterLevel(&s.buf, b.compressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.write(metadata); err != nil {
+		return nil, err
+	}
+	b.streams = append(b.streams, s)
+	b.streamsByMetadata[key] = s
+	return s, nil
+}
+
+func (s *metadataStream) write(data []byte) error {
+	s.size += len(data)
+	if s.gw != nil {
+		_, err := s.gw.Write(data)
+		return err
+	}
+	_, err := s.buf.Write(data)
+	return err
+}
+
+// seal completes the current request of the stream, the events added
+// next go to a new request starting with the metadata.
+func (s *metadataStream) seal() {
+	s.sealed = append(s.sealed, BatchData{APMData: s.toAPMData(), Count: s.count})
+	// The sealed data keeps the buffer, continue in a new one.
+	s.buf = bytes.Buffer{}
+	if s.gw != nil {
+		s.gw.Reset(&s.buf)
+	}
+	s.count, s.size = 0, 0
+	// Writing to a bytes.Buffer never fails.
+	_ = s.write(s.metadata)
+}
+
+// reset drops the events of the stream, keeping the metadata.
+func (s *metadataStream) reset() {
+	s.sealed = nil
+	s.count, s.size = 0, len(s.metadata)
+	if s.gw == nil {
+		s.buf.Truncate(len(s.metadata))
+		return
+	}
+	// A compressed stream cannot be truncated, start a new one.
+	s.buf.Reset()
+	s.gw.Reset(&s.buf)
+	// Writing to a bytes.Buffer never fails.
+	_, _ = s.gw.Write(s.metadata)
+}
+
+func (s *metadataStream) toAPMData() APMData {
+	if s.gw == nil {
+		return APMData{
+			Data: s.buf.Bytes(),
+		}
+	}
+	_ = s.gw.Close()
+	data := APMData{
+		Data:            s.buf.Bytes(),
+		ContentEncoding: "gzip",
+	}
+	// Any data added before the batch is reset goes to a new gzip
+	// member to keep the stream valid.
+	s.gw.Reset(&s.buf)
+	return data
+}
+
 func isTransactionEvent(body []byte) bool {
+	return isEvent(body, transactionKey)
+}
+
+// isEvent returns true if the first key of the event is eventKey.
+func isEvent(body, eventKey []byte) bool {
 	var key []byte
 	for i, r := range body {
 		if r == '"' || r == '\'' {
@@ -294,11 +647,11 @@ func isTransactionEvent(body []byte) bool {
 			break
 		}
 	}
-	if len(key) < len(transactionKey) {
+	if len(key) < len(eventKey) {
 		return false
 	}
-	for i := 0; i < len(transactionKey); i++ {
-		if transactionKey[i] != key[i] {
+	for i := 0; i < len(eventKey); i++ {
+		if eventKey[i] != key[i] {
 			return false
 		}
 	}
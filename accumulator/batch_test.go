@@ -18,6 +18,7 @@
 package accumulator
 
 import (
+	"compress/gzip"
 	"fmt"
 	"testing"
 	"time"
@@ -62,6 +63,51 @@ func TestReset(t *testing.T) {
 	assert.True(t, b.age.IsZero())
 }
 
+func TestCompression(t *testing.T) {
+	b := NewBatch(10, time.Hour, WithCompression(gzip.BestSpeed))
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata)}))
+	require.NoError(t, b.AddLambdaData([]byte(`{"log":{"message":"1"}}`)))
+
+	assertData := func(expected string) {
+		data := b.ToAPMData()[0]
+		require.Equal(t, "gzip", data.ContentEncoding)
+		raw, err := GetUncompressedBytes(data.Data, data.ContentEncoding)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(raw))
+	}
+	assertData(metadata + "\n" + `{"log":{"message":"1"}}`)
+
+	// The metadata is preserved across resets
+	b.Reset()
+	require.NoError(t, b.AddLambdaData([]byte(`{"log":{"message":"2"}}`)))
+	assertData(metadata + "\n" + `{"log":{"message":"2"}}`)
+}
+
+func TestMultipleMetadata(t *testing.T) {
+	other := `{"metadata":{"service":{"name":"worker","agent":{"name":"python","version":"6.0.0"}}}}`
+	b := NewBatch(10, time.Hour)
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + `{"span":{"id":"1"}}`)}))
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(other + "\n" + `{"span":{"id":"2"}}`)}))
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + `{"span":{"id":"3"}}`)}))
+	require.NoError(t, b.AddLambdaData([]byte(`{"log":{}}`)))
+	require.Equal(t, 4, b.Count())
+
+	data := b.ToAPMData()
+	require.Len(t, data, 2)
+	assert.Equal(t, 3, data[0].Count)
+	assert.Equal(t, metadata+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"span":{"id":"3"}}`+"\n"+`{"log":{}}`, string(data[0].Data))
+	assert.Equal(t, 1, data[1].Count)
+	assert.Equal(t, other+"\n"+`{"span":{"id":"2"}}`, string(data[1].Data))
+
+	// Only the metadata first received is kept across resets.
+	b.Reset()
+	data = b.ToAPMData()
+	require.Len(t, data, 1)
+	assert.Equal(t, metadata, string(data[0].Data))
+}
+
 func TestShouldShip_ReasonSize(t *testing.T) {
 	b := NewBatch(10, time.Hour)
 	b.RegisterInvocation("test", "arn", 500, time.Now())
@@ -204,7 +250,7 @@ func TestLifecycle(t *testing.T) {
 			}
 			// Instance shutdown
 			require.NoError(t, b.OnShutdown("timeout"))
-			assert.Equal(t, tc.expected, string(b.ToAPMData().Data))
+			assert.Equal(t, tc.expected, string(b.ToAPMData()[0].Data))
 		})
 	}
 }
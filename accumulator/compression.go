@@ -0,0 +1,256 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"math"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Compression strategies of composite spans.
+const (
+	ExactMatch = "exact_match"
+	SameKind   = "same_kind"
+)
+
+// DefaultExactMatchMaxDuration is the default maximum duration of the
+// spans compressed when they are an exact match.
+const DefaultExactMatchMaxDuration time.Duration = 50 * time.Millisecond
+
+// SpanCompression configures the compression of consecutive sibling exit
+// spans into composite spans, following the span compression spec of the
+// agents. Spans are only compressed within a single agent payload.
+type SpanCompression struct {
+	// ExactMatchMaxDuration is the maximum duration of the spans with the
+	// same name and destination that are compressed.
+	ExactMatchMaxDuration time.Duration
+	// SameKindMaxDuration is the maximum duration of the spans with the
+	// same destination that are compressed. Zero disables the strategy.
+	SameKindMaxDuration time.Duration
+}
+
+// WithSpanCompression compresses the spans of the agents, when the agents
+// don't, to reduce the number of events shipped.
+func WithSpanCompression(cfg SpanCompression) BatchOption {
+	return func(b *Batch) {
+		b.compression = &cfg
+	}
+}
+
+// compressedSpan is a span, or a composite span, waiting for its next
+// sibling to end.
+type compressedSpan struct {
+	data []byte
+	name string
+	// target is the destination of the span, kind identifies its type
+	// and destination.
+	target string
+	kind   string
+	// timestamp is in microseconds, durations in milliseconds, as in
+	// the span event.
+	timestamp float64
+	duration  float64
+	// count, sum and strategy are set once the span is composite.
+	count    int
+	sum      float64
+	strategy string
+}
+
+// spanCompressor compresses the spans of an agent payload. The events must
+// be added in the order they were received, the spans ending before their
+// parent, and the compressor must be flushed at the end of the payload.
+type spanCompressor struct {
+	cfg *SpanCompression
+	// buffered holds the last compressible span of each parent.
+	buffered map[string]*compressedSpan
+	// parents holds the IDs of the parents with a buffered span in the
+	// order the spans were buffered, to flush them in order.
+	parents []string
+	// seenParents holds the IDs of the events that have children, which
+	// are not compressible as a composite span can't be a parent.
+	seenParents map[string]bool
+}
+
+func newSpanCompressor(cfg *SpanCompression) *spanCompressor {
+	return &spanCompressor{
+		cfg:         cfg,
+		buffered:    make(map[string]*compressedSpan),
+		seenParents: make(map[string]bool),
+	}
+}
+
+// add processes an event, returning the events ready to be added to the
+// batch.
+func (c *spanCompressor) add(data []byte) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+	var out [][]byte
+	if !isEvent(data, spanKey) && !isTransactionEvent(data) {
+		return append(out, data)
+	}
+	key := "transaction"
+	if isEvent(data, spanKey) {
+		key = "span"
+	}
+	event := gjson.GetBytes(data, key)
+	// The children of the event end before it.
+	out = c.flushParent(out, event.Get("id").Str)
+	if key != "span" {
+		return append(out, data)
+	}
+
+	parentID := event.Get("parent_id").Str
+	c.seenParents[parentID] = true
+	span, ok := c.compressible(data, event)
+	if !ok {
+		out = c.flushParent(out, parentID)
+		return append(out, data)
+	}
+	buffered, ok := c.buffered[parentID]
+	if !ok {
+		c.buffered[parentID] = span
+		c.parents = append(c.parents, parentID)
+		return out
+	}
+	if c.tryCompress(buffered, span) {
+		return out
+	}
+	out = append(out, buffered.marshal())
+	c.buffered[parentID] = span
+	return out
+}
+
+// flush returns all the buffered spans.
+func (c *spanCompressor) flush() [][]byte {
+	var out [][]byte
+	for len(c.parents) > 0 {
+		out = c.flushParent(out, c.parents[0])
+	}
+	return out
+}
+
+func (c *spanCompressor) flushParent(out [][]byte, parentID string) [][]byte {
+	span, ok := c.buffered[parentID]
+	if !ok {
+		return out
+	}
+	delete(c.buffered, parentID)
+	for i, id := range c.parents {
+		if id == parentID {
+			c.parents = append(c.parents[:i], c.parents[i+1:]...)
+			break
+		}
+	}
+	return append(out, span.marshal())
+}
+
+// compressible returns the span if it is an exit span that can be
+// compressed: it has a destination, didn't fail, has no children and is
+// not already composite.
+func (c *spanCompressor) compressible(data []byte, span gjson.Result) (*compressedSpan, bool) {
+	if c.seenParents[span.Get("id").Str] || span.Get("composite").Exists() || span.Get("outcome").Str == "failure" {
+		return nil, false
+	}
+	target := span.Get("context.service.target.type").Str
+	if target != "" {
+		if name := span.Get("context.service.target.name").Str; name != "" {
+			target += "/" + name
+		}
+	} else {
+		target = span.Get("context.destination.service.resource").Str
+	}
+	if target == "" {
+		return nil, false
+	}
+	return &compressedSpan{
+		data:      data,
+		name:      span.Get("name").Str,
+		target:    target,
+		kind:      span.Get("type").Str + "\x00" + span.Get("subtype").Str + "\x00" + target,
+		timestamp: span.Get("timestamp").Float(),
+		duration:  span.Get("duration").Float(),
+	}, true
+}
+
+// tryCompress compresses the span into the buffered one, returning false
+// if they are not compressible together.
+func (c *spanCompressor) tryCompress(buffered, span *compressedSpan) bool {
+	if buffered.kind != span.kind {
+		return false
+	}
+	exactMatch := float64(c.cfg.ExactMatchMaxDuration) / float64(time.Millisecond)
+	sameKind := float64(c.cfg.SameKindMaxDuration) / float64(time.Millisecond)
+
+	switch buffered.strategy {
+	case "":
+		switch {
+		case buffered.name == span.name && buffered.duration <= exactMatch && span.duration <= exactMatch:
+			buffered.strategy = ExactMatch
+		case buffered.duration <= sameKind && span.duration <= sameKind:
+			buffered.strategy = SameKind
+			buffered.name = "Calls to " + buffered.target
+		default:
+			return false
+		}
+		buffered.count, buffered.sum = 1, buffered.duration
+	case ExactMatch:
+		if buffered.name != span.name || span.duration > exactMatch {
+			return false
+		}
+	case SameKind:
+		if span.duration > sameKind {
+			return false
+		}
+	}
+
+	end := math.Max(buffered.timestamp+buffered.duration*1000, span.timestamp+span.duration*1000)
+	buffered.timestamp = math.Min(buffered.timestamp, span.timestamp)
+	buffered.duration = (end - buffered.timestamp) / 1000
+	buffered.count++
+	buffered.sum += span.duration
+	return true
+}
+
+// marshal returns the span event, with the composite fields if the span
+// is composite.
+func (s *compressedSpan) marshal() []byte {
+	if s.strategy == "" {
+		return s.data
+	}
+	data := s.data
+	for _, field := range []struct {
+		path  string
+		value interface{}
+	}{
+		{path: "span.name", value: s.name},
+		{path: "span.timestamp", value: int64(s.timestamp)},
+		{path: "span.duration", value: s.duration},
+		{path: "span.composite.count", value: s.count},
+		{path: "span.composite.sum", value: s.sum},
+		{path: "span.composite.compression_strategy", value: s.strategy},
+	} {
+		if out, err := sjson.SetBytes(data, field.path, field.value); err == nil {
+			data = out
+		}
+	}
+	return data
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dynamoDBSpan(id, name string, timestamp int, duration float64) string {
+	return fmt.Sprintf(`{"span":{"id":"%s","parent_id":"txn","name":"%s","type":"db","subtype":"dynamodb","timestamp":%d,"duration":%g,"outcome":"success","context":{"service":{"target":{"type":"dynamodb","name":"table"}}}}}`, id, name, timestamp, duration)
+}
+
+func TestSpanCompression(t *testing.T) {
+	txn := `{"transaction":{"id":"txn"}}`
+	for name, tc := range map[string]struct {
+		events   []string
+		expected []string
+	}{
+		"exact match": {
+			events: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "GetItem", 4000, 3),
+				dynamoDBSpan("3", "GetItem", 8000, 1),
+				txn,
+			},
+			expected: []string{
+				`{"span":{"id":"1","parent_id":"txn","name":"GetItem","type":"db","subtype":"dynamodb","timestamp":1000,"duration":8,"outcome":"success","context":{"service":{"target":{"type":"dynamodb","name":"table"}}},"composite":{"count":3,"sum":6,"compression_strategy":"exact_match"}}}`,
+				txn,
+			},
+		},
+		"same kind": {
+			events: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "PutItem", 4000, 3),
+				txn,
+			},
+			expected: []string{
+				`{"span":{"id":"1","parent_id":"txn","name":"Calls to dynamodb/table","type":"db","subtype":"dynamodb","timestamp":1000,"duration":6,"outcome":"success","context":{"service":{"target":{"type":"dynamodb","name":"table"}}},"composite":{"count":2,"sum":5,"compression_strategy":"same_kind"}}}`,
+				txn,
+			},
+		},
+		"too long": {
+			events: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "GetItem", 4000, 100),
+				txn,
+			},
+			expected: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "GetItem", 4000, 100),
+				txn,
+			},
+		},
+		"interrupted": {
+			events: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				`{"span":{"id":"2","parent_id":"txn","name":"internal","type":"app"}}`,
+				dynamoDBSpan("3", "GetItem", 8000, 1),
+				txn,
+			},
+			expected: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				`{"span":{"id":"2","parent_id":"txn","name":"internal","type":"app"}}`,
+				dynamoDBSpan("3", "GetItem", 8000, 1),
+				txn,
+			},
+		},
+		"parent": {
+			events: []string{
+				`{"span":{"id":"child","parent_id":"1","name":"internal","type":"app"}}`,
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "GetItem", 4000, 3),
+			},
+			expected: []string{
+				`{"span":{"id":"child","parent_id":"1","name":"internal","type":"app"}}`,
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				dynamoDBSpan("2", "GetItem", 4000, 3),
+			},
+		},
+		"failure": {
+			events: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				strings.Replace(dynamoDBSpan("2", "GetItem", 4000, 3), "success", "failure", 1),
+			},
+			expected: []string{
+				dynamoDBSpan("1", "GetItem", 1000, 2),
+				strings.Replace(dynamoDBSpan("2", "GetItem", 4000, 3), "success", "failure", 1),
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch(10, time.Hour, WithSpanCompression(SpanCompression{
+				ExactMatchMaxDuration: DefaultExactMatchMaxDuration,
+				SameKindMaxDuration:   10 * time.Millisecond,
+			}))
+			b.RegisterInvocation("test", "arn", 500, time.Now())
+			require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + strings.Join(tc.events, "\n"))}))
+
+			assert.Equal(t, len(tc.expected), b.Count())
+			assert.Equal(t, metadata+"\n"+strings.Join(tc.expected, "\n"), string(b.ToAPMData()[0].Data))
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Default limits of a batch. The byte limits are aligned with the default
+// max_event_size of APM Server.
+const (
+	DefaultMaxSize       int           = 50
+	DefaultMaxAge        time.Duration = 2 * time.Second
+	DefaultMaxBytes      int           = 1024 * 1024
+	DefaultMaxEventBytes int           = 300 * 1024
+)
+
+// ErrEventTooLarge is returned when events exceeding the maximum event
+// size are dropped.
+var ErrEventTooLarge = errors.New("event exceeds the maximum event size")
+
+// TooLargeError reports the number of events dropped as they exceeded the
+// maximum event size. It matches ErrEventTooLarge.
+type TooLargeError struct {
+	Dropped int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("%d events exceeded the maximum event size", e.Dropped)
+}
+
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrEventTooLarge
+}
+
+// OversizedEventPolicy represents how the batch handles the events that
+// exceed the maximum event size.
+type OversizedEventPolicy string
+
+const (
+	// TruncateOversized strips the stacktraces and truncates the strings
+	// of the event until it fits, the event is dropped if it doesn't.
+	TruncateOversized OversizedEventPolicy = "truncate"
+
+	// DropOversized drops the event.
+	DropOversized OversizedEventPolicy = "drop"
+)
+
+// truncateLengths are the string lengths, in bytes, oversized events are
+// truncated to until they fit.
+var truncateLengths = []int{8192, 1024, 256, 64}
+
+// WithMaxBytes sets the maximum size, in uncompressed bytes, of the data
+// shipped in a single request. The data of a metadata exceeding the size
+// is split in several requests. The batch is ready to be shipped once the
+// data of one of its metadata reaches 90% of the size.
+func WithMaxBytes(size int) BatchOption {
+	return func(b *Batch) {
+		b.maxBytes = size
+	}
+}
+
+// WithMaxEventBytes sets the maximum size, in bytes, of a single event
+// and how the events exceeding it are handled.
+func WithMaxEventBytes(size int, policy OversizedEventPolicy) BatchOption {
+	return func(b *Batch) {
+		b.maxEventBytes, b.oversizedPolicy = size, policy
+	}
+}
+
+// fitEvent returns the event within the maximum event size, or false if
+// it must be dropped.
+func (b *Batch) fitEvent(data []byte) ([]byte, bool) {
+	if b.maxEventBytes <= 0 || len(data) <= b.maxEventBytes {
+		return data, true
+	}
+	if b.oversizedPolicy == DropOversized {
+		return nil, false
+	}
+
+	r := &spanRules{stripStacktraces: true}
+	var edits []edit
+	r.collectEdits("", nil, gjson.ParseBytes(data), &edits)
+	stripped := applyEdits(data, edits)
+	if len(stripped) <= b.maxEventBytes {
+		return stripped, true
+	}
+	for _, n := range truncateLengths {
+		r.maxStringLength = n
+		edits = edits[:0]
+		r.collectEdits("", nil, gjson.ParseBytes(stripped), &edits)
+		if truncated := applyEdits(stripped, edits); len(truncated) <= b.maxEventBytes {
+			return truncated, true
+		}
+	}
+	return nil, false
+}
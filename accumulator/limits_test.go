@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxBytes(t *testing.T) {
+	event := `{"log":{"message":"` + strings.Repeat("a", 100) + `"}}`
+	b := NewBatch(100, time.Hour, WithMaxBytes(len(metadata)+5*(len(event)+1)))
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata)}))
+
+	for i := 0; i < 4; i++ {
+		assert.False(t, b.ShouldShip())
+		require.NoError(t, b.AddLambdaData([]byte(event)))
+	}
+	// Should flush at 90% of the max bytes
+	require.NoError(t, b.AddLambdaData([]byte(event)))
+	assert.True(t, b.ShouldShip())
+
+	// The data exceeding the max bytes goes to a new request
+	require.NoError(t, b.AddLambdaData([]byte(event)))
+	data := b.ToAPMData()
+	require.Len(t, data, 2)
+	assert.Equal(t, 5, data[0].Count)
+	assert.Equal(t, metadata+"\n"+event, string(data[1].Data))
+
+	b.Reset()
+	assert.False(t, b.ShouldShip())
+	assert.NoError(t, b.AddLambdaData([]byte(event)))
+	require.Len(t, b.ToAPMData(), 1)
+}
+
+func TestMaxBytesPayload(t *testing.T) {
+	event := `{"log":{"message":"` + strings.Repeat("a", 100) + `"}}`
+	maxBytes := len(metadata) + 3*(len(event)+1)
+	for name, opts := range map[string][]BatchOption{
+		"uncompressed": {WithMaxBytes(maxBytes)},
+		"compressed":   {WithMaxBytes(maxBytes), WithCompression(1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch(100, time.Hour, opts...)
+			b.RegisterInvocation("test", "arn", 500, time.Now())
+
+			// The events of a payload exceeding the max bytes are all
+			// added, split in requests within the max bytes.
+			payload := metadata + strings.Repeat("\n"+event, 8)
+			require.NoError(t, b.AddAgentData(APMData{Data: []byte(payload)}))
+			assert.Equal(t, 8, b.Count())
+			assert.True(t, b.ShouldShip())
+
+			var events int
+			for _, data := range b.ToAPMData() {
+				raw, err := GetUncompressedBytes(data.Data, data.ContentEncoding)
+				require.NoError(t, err)
+				assert.LessOrEqual(t, len(raw), maxBytes)
+				assert.Equal(t, metadata+strings.Repeat("\n"+event, data.Count), string(raw))
+				events += data.Count
+			}
+			assert.Equal(t, 8, events)
+		})
+	}
+}
+
+func TestMaxEventBytes(t *testing.T) {
+	stacktrace := `"stacktrace":[{"filename":"` + strings.Repeat("f", 200) + `"}]`
+	for name, tc := range map[string]struct {
+		policy   OversizedEventPolicy
+		event    string
+		expected string
+	}{
+		"fits": {
+			policy:   TruncateOversized,
+			event:    `{"error":{"id":"1"}}`,
+			expected: `{"error":{"id":"1"}}`,
+		},
+		"strip stacktrace": {
+			policy:   TruncateOversized,
+			event:    `{"error":{"id":"1","exception":{` + stacktrace + `}}}`,
+			expected: `{"error":{"id":"1","exception":{}}}`,
+		},
+		"truncate strings": {
+			policy:   TruncateOversized,
+			event:    `{"error":{"id":"1","log":{"message":"` + strings.Repeat("m", 200) + `"}}}`,
+			expected: `{"error":{"id":"1","log":{"message":"` + strings.Repeat("m", 64) + `"}}}`,
+		},
+		"drop": {
+			policy: DropOversized,
+			event:  `{"error":{"id":"1","exception":{` + stacktrace + `}}}`,
+		},
+		"too many fields": {
+			policy: TruncateOversized,
+			event:  `{"error":{"id":"1","context":{"tags":{` + strings.TrimSuffix(strings.Repeat(`"a":1,`, 50), ",") + `}}}}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch(10, time.Hour, WithMaxEventBytes(128, tc.policy))
+			b.RegisterInvocation("test", "arn", 500, time.Now())
+			err := b.AddAgentData(APMData{Data: []byte(metadata + "\n" + tc.event + "\n" + `{"span":{"id":"2"}}`)})
+
+			data := string(b.ToAPMData()[0].Data)
+			if tc.expected == "" {
+				var tooLarge *TooLargeError
+				require.ErrorAs(t, err, &tooLarge)
+				assert.Equal(t, 1, tooLarge.Dropped)
+				assert.ErrorIs(t, err, ErrEventTooLarge)
+				assert.Equal(t, metadata+"\n"+`{"span":{"id":"2"}}`, data)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, metadata+"\n"+tc.expected+"\n"+`{"span":{"id":"2"}}`, data)
+		})
+	}
+}
@@ -23,8 +23,168 @@ import (
 	"compress/zlib"
 	"fmt"
 	"io"
+	"sort"
+
+	"github.com/elastic/apm-aws-lambda/otlp"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
+// FunctionInfo describes the function the extension runs alongside. It
+// fills in the metadata fields, and the faas fields of the events, that
+// the agent omits.
+type FunctionInfo struct {
+	Name    string
+	Version string
+	Region  string
+	// Runtime is the AWS_EXECUTION_ENV of the function.
+	Runtime          string
+	Architecture     string
+	MemorySizeMB     int
+	LogGroup         string
+	LogStream        string
+	ExtensionVersion string
+}
+
+// SetFunctionInfo sets the description of the function. It must be set
+// before the agent data is added to the batch.
+func (b *Batch) SetFunctionInfo(info FunctionInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.function = &info
+}
+
+// apply fills in the metadata fields that are not set. The region is
+// always set as the agent can't know better than the environment.
+func (f *FunctionInfo) apply(metadata []byte) ([]byte, error) {
+	md := gjson.GetBytes(metadata, "metadata")
+	fields := []struct {
+		path      string
+		value     interface{}
+		overwrite bool
+	}{
+		{path: "service.name", value: f.Name},
+		{path: "service.version", value: f.Version},
+		{path: "service.runtime.name", value: f.Runtime},
+		{path: "service.node.configured_name", value: f.LogStream},
+		{path: "system.architecture", value: f.Architecture},
+		{path: "cloud.provider", value: "aws"},
+		{path: "cloud.region", value: f.Region, overwrite: true},
+		{path: "cloud.service.name", value: "lambda"},
+		{path: "labels.lambda_memory_size_mb", value: f.MemorySizeMB},
+		{path: "labels.lambda_log_group", value: f.LogGroup},
+		{path: "labels.lambda_extension_version", value: f.ExtensionVersion},
+	}
+
+	var err error
+	for _, field := range fields {
+		if field.value == "" || field.value == 0 {
+			continue
+		}
+		if current := md.Get(field.path); !field.overwrite && current.Exists() && current.String() != "" {
+			continue
+		}
+		if metadata, err = sjson.SetBytes(metadata, "metadata."+field.path, field.value); err != nil {
+			return nil, fmt.Errorf("failed to set metadata %s: %w", field.path, err)
+		}
+	}
+	return metadata, nil
+}
+
+// fillFAAS sets the name and version of the function in the faas object
+// of an event, if the event has one that doesn't.
+func (f *FunctionInfo) fillFAAS(data []byte) []byte {
+	var kind string
+	gjson.ParseBytes(data).ForEach(func(key, _ gjson.Result) bool {
+		kind = key.Str
+		return false
+	})
+	if kind == "" {
+		return data
+	}
+	path := escapePathKey(kind) + ".faas"
+	faas := gjson.GetBytes(data, path)
+	if !faas.IsObject() {
+		return data
+	}
+	for _, field := range []struct{ key, value string }{
+		{key: "name", value: f.Name},
+		{key: "version", value: f.Version},
+	} {
+		if field.value == "" || faas.Get(field.key).Exists() {
+			continue
+		}
+		if out, err := sjson.SetBytes(data, path+"."+field.key, field.value); err == nil {
+			data = out
+		}
+	}
+	return data
+}
+
+// MetadataOverrides are applied to the metadata of the agents so that all
+// the data of the function, including the platform metrics and function
+// logs, is described consistently.
+type MetadataOverrides struct {
+	ServiceName        string
+	ServiceEnvironment string
+	ServiceVersion     string
+	// GlobalLabels are added to the labels of the metadata, replacing
+	// the labels with the same key.
+	GlobalLabels map[string]string
+	// Cloud sets fields of the cloud metadata keyed by their path, e.g.
+	// account.id or region.
+	Cloud map[string]string
+}
+
+// WithMetadataOverrides applies the overrides to the metadata of the
+// batch.
+func WithMetadataOverrides(overrides MetadataOverrides) BatchOption {
+	return func(b *Batch) {
+		b.overrides = &overrides
+	}
+}
+
+// apply sets the overrides on a metadata event.
+func (o *MetadataOverrides) apply(metadata []byte) ([]byte, error) {
+	type field struct {
+		path  string
+		value string
+	}
+	var fields []field
+	for _, f := range []field{
+		{path: "service.name", value: o.ServiceName},
+		{path: "service.environment", value: o.ServiceEnvironment},
+		{path: "service.version", value: o.ServiceVersion},
+	} {
+		if f.value != "" {
+			fields = append(fields, f)
+		}
+	}
+	for _, k := range sortedKeys(o.GlobalLabels) {
+		fields = append(fields, field{path: "labels." + escapePathKey(otlp.LabelKey(k)), value: o.GlobalLabels[k]})
+	}
+	for _, k := range sortedKeys(o.Cloud) {
+		fields = append(fields, field{path: "cloud." + k, value: o.Cloud[k]})
+	}
+
+	var err error
+	for _, f := range fields {
+		if metadata, err = sjson.SetBytes(metadata, "metadata."+f.path, f.value); err != nil {
+			return nil, fmt.Errorf("failed to override metadata %s: %w", f.path, err)
+		}
+	}
+	return metadata, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // ProcessMetadata return a byte array containing the Metadata marshaled in JSON
 // In case we want to update the Metadata values, usage of https://github.com/tidwall/sjson is advised
 func ProcessMetadata(data APMData) ([]byte, error) {
@@ -23,7 +23,9 @@ import (
 	"compress/zlib"
 	"io"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -176,3 +178,50 @@ func BenchmarkProcessMetadata(b *testing.B) {
 		})
 	}
 }
+
+func TestMetadataOverrides(t *testing.T) {
+	b := NewBatch(10, time.Hour, WithMetadataOverrides(MetadataOverrides{
+		ServiceName:        "checkout",
+		ServiceEnvironment: "production",
+		GlobalLabels:       map[string]string{"team": "payments", "cost.center": "42"},
+		Cloud:              map[string]string{"account.name": "prod", "region": "eu-west-1"},
+	}))
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(`{"metadata":{"service":{"name":"fn","version":"1"},"labels":{"team":"x","a":"b"},"cloud":{"provider":"aws","region":"us-east-1"}}}`)}))
+	require.NoError(t, b.AddLambdaData([]byte(`{"log":{"message":"test"}}`)))
+
+	assert.Equal(t,
+		`{"metadata":{"service":{"name":"checkout","version":"1","environment":"production"},"labels":{"team":"payments","a":"b","cost_center":"42"},"cloud":{"provider":"aws","region":"eu-west-1","account":{"name":"prod"}}}}`+"\n"+`{"log":{"message":"test"}}`,
+		string(b.ToAPMData()[0].Data),
+	)
+
+	// The metadata is kept across resets.
+	b.Reset()
+	assert.Contains(t, string(b.ToAPMData()[0].Data), `"name":"checkout"`)
+}
+
+func TestFunctionInfo(t *testing.T) {
+	b := NewBatch(10, time.Hour, WithMetadataOverrides(MetadataOverrides{ServiceVersion: "override"}))
+	b.SetFunctionInfo(FunctionInfo{
+		Name:             "fn",
+		Version:          "$LATEST",
+		Region:           "eu-west-1",
+		Runtime:          "AWS_Lambda_python3.9",
+		Architecture:     "arm64",
+		MemorySizeMB:     512,
+		LogGroup:         "/aws/lambda/fn",
+		LogStream:        "2022/10/17/[$LATEST]abc",
+		ExtensionVersion: "1.2.0",
+	})
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(`{"metadata":{"service":{"name":"custom","runtime":{"name":""}},"cloud":{"region":"us-east-1"}}}`)}))
+	require.NoError(t, b.AddLambdaData([]byte(`{"metricset":{"faas":{"id":"arn"},"samples":{}}}`)))
+	require.NoError(t, b.AddLambdaData([]byte(`{"log":{"message":"test"}}`)))
+
+	assert.Equal(t,
+		`{"metadata":{"service":{"name":"custom","runtime":{"name":"AWS_Lambda_python3.9"},"version":"override","node":{"configured_name":"2022/10/17/[$LATEST]abc"}},"cloud":{"region":"eu-west-1","provider":"aws","service":{"name":"lambda"}},"system":{"architecture":"arm64"},"labels":{"lambda_memory_size_mb":512,"lambda_log_group":"/aws/lambda/fn","lambda_extension_version":"1.2.0"}}}`+"\n"+
+			`{"metricset":{"faas":{"id":"arn","name":"fn","version":"$LATEST"},"samples":{}}}`+"\n"+
+			`{"log":{"message":"test"}}`,
+		string(b.ToAPMData()[0].Data),
+	)
+}
@@ -0,0 +1,226 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// RedactedValue replaces the redacted values.
+const RedactedValue = "[REDACTED]"
+
+// RedactionRules configure the masking of sensitive data by a Redactor.
+type RedactionRules struct {
+	// FieldNames are the names of the request headers, cookies, body
+	// fields, URL query parameters and labels whose values are masked.
+	// The names are case insensitive and may contain * wildcards.
+	FieldNames []string
+	// ValuePatterns are regular expressions whose matches in any string
+	// value are masked, e.g. card numbers or AWS access keys.
+	ValuePatterns []string
+}
+
+// Redactor masks sensitive data in events before they leave the
+// extension.
+type Redactor struct {
+	fieldNames    []*regexp.Regexp
+	valuePatterns []*regexp.Regexp
+}
+
+// NewRedactor returns a Redactor applying the rules.
+func NewRedactor(rules RedactionRules) (*Redactor, error) {
+	r := &Redactor{fieldNames: compileWildcards(rules.FieldNames)}
+	for _, p := range rules.ValuePatterns {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", p, err)
+		}
+		r.valuePatterns = append(r.valuePatterns, re)
+	}
+	return r, nil
+}
+
+// WithRedactor masks sensitive data in the agent events and the proxy
+// transactions added to the batch.
+func WithRedactor(r *Redactor) BatchOption {
+	return func(b *Batch) {
+		b.redactor = r
+	}
+}
+
+// Redact masks the sensitive data of an intake v2 event.
+func (r *Redactor) Redact(data []byte) []byte {
+	if len(r.fieldNames) > 0 {
+		var edits []edit
+		gjson.ParseBytes(data).ForEach(func(kind, event gjson.Result) bool {
+			r.collectFieldEdits(escapePathKey(kind.Str), kind.Str, event, &edits)
+			return true
+		})
+		data = applyEdits(data, edits)
+	}
+	if len(r.valuePatterns) > 0 {
+		var edits []edit
+		r.collectValueEdits("", gjson.ParseBytes(data), &edits)
+		data = applyEdits(data, edits)
+	}
+	return data
+}
+
+func (r *Redactor) collectFieldEdits(path, kind string, event gjson.Result, edits *[]edit) {
+	if kind == "metadata" {
+		r.maskFields(joinPath(path, "labels"), event.Get("labels"), false, edits)
+		return
+	}
+
+	ctx := joinPath(path, "context")
+	for _, p := range []string{"request.headers", "request.cookies", "response.headers", "tags"} {
+		r.maskFields(joinPath(ctx, p), event.Get("context."+p), false, edits)
+	}
+	body := event.Get("context.request.body")
+	switch {
+	case body.IsObject():
+		r.maskFields(joinPath(ctx, "request.body"), body, true, edits)
+	case body.Type == gjson.String:
+		if masked, ok := r.maskQuery(body.Str); ok {
+			*edits = append(*edits, edit{path: joinPath(ctx, "request.body"), value: masked})
+		}
+	}
+	for _, p := range []string{"request.url.search", "request.url.full", "request.url.raw", "http.url", "page.url"} {
+		v := event.Get("context." + p)
+		if v.Type != gjson.String {
+			continue
+		}
+		if masked, ok := r.maskURL(v.Str); ok {
+			*edits = append(*edits, edit{path: joinPath(ctx, p), value: masked})
+		}
+	}
+}
+
+// maskFields masks the values of the keys of an object matching the
+// field names, descending into nested objects if recursive is true.
+func (r *Redactor) maskFields(path string, v gjson.Result, recursive bool, edits *[]edit) {
+	if !v.IsObject() {
+		return
+	}
+	v.ForEach(func(key, value gjson.Result) bool {
+		p := joinPath(path, escapePathKey(key.Str))
+		switch {
+		case matchAny(r.fieldNames, key.Str):
+			*edits = append(*edits, edit{path: p, value: RedactedValue})
+		case recursive:
+			r.maskFields(p, value, recursive, edits)
+		}
+		return true
+	})
+}
+
+// maskURL masks the values of the query parameters of a URL, or of a
+// query string with or without the leading question mark.
+func (r *Redactor) maskURL(s string) (string, bool) {
+	prefix, query := "", s
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		prefix, query = s[:i+1], s[i+1:]
+	} else if strings.Contains(s, "://") || strings.HasPrefix(s, "/") {
+		return s, false
+	}
+	fragment := ""
+	if i := strings.IndexByte(query, '#'); i >= 0 {
+		query, fragment = query[:i], query[i:]
+	}
+	masked, ok := r.maskQuery(query)
+	return prefix + masked + fragment, ok
+}
+
+// maskQuery masks the values of the parameters of a URL encoded query,
+// keeping the encoding of the other parameters.
+func (r *Redactor) maskQuery(query string) (string, bool) {
+	if !strings.Contains(query, "=") {
+		return query, false
+	}
+	params := strings.Split(query, "&")
+	masked := false
+	for i, param := range params {
+		key, _, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if matchAny(r.fieldNames, key) {
+			params[i] = param[:strings.IndexByte(param, '=')+1] + RedactedValue
+			masked = true
+		}
+	}
+	return strings.Join(params, "&"), masked
+}
+
+func (r *Redactor) collectValueEdits(path string, v gjson.Result, edits *[]edit) {
+	switch {
+	case v.IsObject():
+		v.ForEach(func(key, value gjson.Result) bool {
+			r.collectValueEdits(joinPath(path, escapePathKey(key.Str)), value, edits)
+			return true
+		})
+	case v.IsArray():
+		i := 0
+		v.ForEach(func(_, value gjson.Result) bool {
+			r.collectValueEdits(joinPath(path, strconv.Itoa(i)), value, edits)
+			i++
+			return true
+		})
+	case v.Type == gjson.String:
+		s := v.Str
+		for _, re := range r.valuePatterns {
+			s = re.ReplaceAllLiteralString(s, RedactedValue)
+		}
+		if s != v.Str {
+			*edits = append(*edits, edit{path: path, value: s})
+		}
+	}
+}
+
+// applyEdits applies the edits to an event. The paths are built from the
+// event itself, an edit that fails leaves the value as is.
+func applyEdits(data []byte, edits []edit) []byte {
+	for _, e := range edits {
+		var (
+			out []byte
+			err error
+		)
+		if e.delete {
+			out, err = sjson.DeleteBytes(data, e.path)
+		} else {
+			out, err = sjson.SetBytes(data, e.path, e.value)
+		}
+		if err == nil {
+			data = out
+		}
+	}
+	return data
+}
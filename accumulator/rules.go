@@ -0,0 +1,285 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var spanKey = []byte("span")
+
+// SpanRules are the processing rules applied to the agent events before
+// they are added to the batch.
+type SpanRules struct {
+	// MinDuration drops the spans shorter than the duration. The children
+	// of a dropped span received in the same payload are kept and
+	// re-parented to the parent of the dropped span, and the dropped spans
+	// are added to the span_count.dropped of their transaction if it is
+	// received in the same payload.
+	MinDuration time.Duration
+	// DropNames and DropTypes drop the spans whose name or type matches
+	// one of the patterns. The patterns are case insensitive and may
+	// contain * wildcards.
+	DropNames []string
+	DropTypes []string
+	// StripStacktraces removes the stacktraces of spans and errors.
+	StripStacktraces bool
+	// MaxStringLength truncates the free-text values of the events, the
+	// database statements, messages, bodies and labels, to the given
+	// number of bytes. Identifiers and keywords are never truncated. Zero
+	// disables the truncation.
+	MaxStringLength int
+}
+
+// WithSpanRules applies the rules to the agent events added to the batch.
+func WithSpanRules(rules SpanRules) BatchOption {
+	return func(b *Batch) {
+		b.rules = newSpanRules(rules)
+	}
+}
+
+type spanRules struct {
+	// minDuration is in milliseconds, as the duration of spans.
+	minDuration      float64
+	dropNames        []*regexp.Regexp
+	dropTypes        []*regexp.Regexp
+	stripStacktraces bool
+	maxStringLength  int
+
+	// dropped maps the ids of the spans dropped from the payload being
+	// processed to their parent id, and droppedCount counts them by
+	// transaction id.
+	dropped      map[string]string
+	droppedCount map[string]int
+}
+
+func newSpanRules(rules SpanRules) *spanRules {
+	return &spanRules{
+		minDuration:      float64(rules.MinDuration) / float64(time.Millisecond),
+		dropNames:        compileWildcards(rules.DropNames),
+		dropTypes:        compileWildcards(rules.DropTypes),
+		stripStacktraces: rules.StripStacktraces,
+		maxStringLength:  rules.MaxStringLength,
+	}
+}
+
+// compileWildcards compiles case insensitive patterns in which * matches
+// any sequence of characters.
+func compileWildcards(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		expr := strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*")
+		res = append(res, regexp.MustCompile("(?is)^"+expr+"$"))
+	}
+	return res
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare collects the spans dropped from the events of a payload, it
+// must be called before the events are applied.
+func (r *spanRules) prepare(events []byte) {
+	r.dropped, r.droppedCount = nil, nil
+	if r.minDuration <= 0 && len(r.dropNames) == 0 && len(r.dropTypes) == 0 {
+		return
+	}
+	for len(events) > 0 {
+		var data []byte
+		data, events, _ = bytes.Cut(events, newLineSep)
+		if !isEvent(data, spanKey) {
+			continue
+		}
+		span := gjson.GetBytes(data, "span")
+		if !r.drop(span) {
+			continue
+		}
+		if r.dropped == nil {
+			r.dropped = make(map[string]string)
+			r.droppedCount = make(map[string]int)
+		}
+		if id := span.Get("id").Str; id != "" {
+			r.dropped[id] = span.Get("parent_id").Str
+		}
+		r.droppedCount[span.Get("transaction_id").Str]++
+	}
+}
+
+// drop returns true if the span must be dropped.
+func (r *spanRules) drop(span gjson.Result) bool {
+	if r.minDuration > 0 {
+		if d := span.Get("duration"); d.Exists() && d.Float() < r.minDuration {
+			return true
+		}
+	}
+	return matchAny(r.dropNames, span.Get("name").Str) || matchAny(r.dropTypes, span.Get("type").Str)
+}
+
+// keptParent returns the closest ancestor of a dropped span that is kept.
+func (r *spanRules) keptParent(id string) (string, bool) {
+	parent, ok := r.dropped[id]
+	if !ok {
+		return "", false
+	}
+	// Bound the lookups in case the parent ids form a cycle.
+	for i := 0; i < len(r.dropped); i++ {
+		next, ok := r.dropped[parent]
+		if !ok {
+			break
+		}
+		parent = next
+	}
+	return parent, true
+}
+
+// apply processes an event, returning false if it must be dropped.
+func (r *spanRules) apply(data []byte) ([]byte, bool) {
+	switch {
+	case isEvent(data, spanKey):
+		span := gjson.GetBytes(data, "span")
+		if r.drop(span) {
+			return nil, false
+		}
+		if parent, ok := r.keptParent(span.Get("parent_id").Str); ok {
+			if out, err := sjson.SetBytes(data, "span.parent_id", parent); err == nil {
+				data = out
+			}
+		}
+	case len(r.droppedCount) > 0 && isTransactionEvent(data):
+		txn := gjson.GetBytes(data, "transaction")
+		if n := r.droppedCount[txn.Get("id").Str]; n > 0 {
+			n += int(txn.Get("span_count.dropped").Int())
+			if out, err := sjson.SetBytes(data, "transaction.span_count.dropped", n); err == nil {
+				data = out
+			}
+		}
+	}
+	if !r.stripStacktraces && r.maxStringLength <= 0 {
+		return data, true
+	}
+
+	var edits []edit
+	r.collectEdits("", nil, gjson.ParseBytes(data), &edits)
+	return applyEdits(data, edits), true
+}
+
+// edit is a change to the value at the sjson path of an event.
+type edit struct {
+	path   string
+	value  string
+	delete bool
+}
+
+// collectEdits collects the edits of the value at path, keys being the
+// object keys of the path.
+func (r *spanRules) collectEdits(path string, keys []string, v gjson.Result, edits *[]edit) {
+	switch {
+	case v.IsObject():
+		v.ForEach(func(key, value gjson.Result) bool {
+			p := joinPath(path, escapePathKey(key.Str))
+			if r.stripStacktraces && key.Str == "stacktrace" {
+				*edits = append(*edits, edit{path: p, delete: true})
+				return true
+			}
+			r.collectEdits(p, append(keys, key.Str), value, edits)
+			return true
+		})
+	case v.IsArray():
+		i := 0
+		v.ForEach(func(_, value gjson.Result) bool {
+			r.collectEdits(joinPath(path, strconv.Itoa(i)), keys, value, edits)
+			i++
+			return true
+		})
+	case v.Type == gjson.String:
+		if r.maxStringLength > 0 && len(v.Str) > r.maxStringLength && isFreeText(keys) {
+			*edits = append(*edits, edit{path: path, value: truncate(v.Str, r.maxStringLength)})
+		}
+	}
+}
+
+// isFreeText returns true if the string at the object keys is a free-text
+// value that can be truncated.
+func isFreeText(keys []string) bool {
+	n := len(keys)
+	if n < 2 {
+		return false
+	}
+	parent, key := keys[n-2], keys[n-1]
+	switch {
+	case key == "message":
+		return true
+	case parent == "db" && key == "statement":
+		return true
+	case (parent == "request" || parent == "message") && key == "body":
+		return true
+	case (parent == "tags" || parent == "labels") && n >= 3:
+		return true
+	}
+	return false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// escapePathKey escapes the characters of an object key that have a
+// meaning in sjson paths.
+func escapePathKey(key string) string {
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c < utf8.RuneSelf && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// truncate truncates s to at most n bytes without splitting a UTF-8
+// encoded character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
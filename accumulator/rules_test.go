@@ -0,0 +1,130 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanRules(t *testing.T) {
+	for name, tc := range map[string]struct {
+		rules    SpanRules
+		event    string
+		expected string
+	}{
+		"no rules": {
+			event:    `{"span":{"name":"SELECT","type":"db","duration":0.5}}`,
+			expected: `{"span":{"name":"SELECT","type":"db","duration":0.5}}`,
+		},
+		"shorter than min duration": {
+			rules: SpanRules{MinDuration: time.Millisecond},
+			event: `{"span":{"name":"SELECT","type":"db","duration":0.5}}`,
+		},
+		"longer than min duration": {
+			rules:    SpanRules{MinDuration: time.Millisecond},
+			event:    `{"span":{"name":"SELECT","type":"db","duration":1.5}}`,
+			expected: `{"span":{"name":"SELECT","type":"db","duration":1.5}}`,
+		},
+		"min duration ignores transactions": {
+			rules:    SpanRules{MinDuration: time.Millisecond},
+			event:    `{"transaction":{"name":"handler","duration":0.5}}`,
+			expected: `{"transaction":{"name":"handler","duration":0.5}}`,
+		},
+		"matching name": {
+			rules: SpanRules{DropNames: []string{"redis *"}},
+			event: `{"span":{"name":"Redis GET","type":"db"}}`,
+		},
+		"matching type": {
+			rules: SpanRules{DropTypes: []string{"app", "db*"}},
+			event: `{"span":{"name":"GET","type":"db.redis.query"}}`,
+		},
+		"not matching": {
+			rules:    SpanRules{DropNames: []string{"redis *"}, DropTypes: []string{"app"}},
+			event:    `{"span":{"name":"GET /redis","type":"external"}}`,
+			expected: `{"span":{"name":"GET /redis","type":"external"}}`,
+		},
+		"strip stacktraces": {
+			rules:    SpanRules{StripStacktraces: true},
+			event:    `{"error":{"exception":{"message":"boom","stacktrace":[{"function":"f"}],"cause":[{"stacktrace":[{"function":"g"}]}]},"log":{"stacktrace":[]}}}`,
+			expected: `{"error":{"exception":{"message":"boom","cause":[{}]},"log":{}}}`,
+		},
+		"truncate strings": {
+			rules:    SpanRules{MaxStringLength: 6},
+			event:    `{"span":{"name":"SELECT","context":{"db":{"statement":"SELECT * FROM users"},"tags":{"a.b":"ééééé"}}}}`,
+			expected: `{"span":{"name":"SELECT","context":{"db":{"statement":"SELECT"},"tags":{"a.b":"ééé"}}}}`,
+		},
+		"truncate keeps identifiers and keywords": {
+			rules:    SpanRules{MaxStringLength: 6},
+			event:    `{"span":{"id":"0102030405060708","trace_id":"0102030405060708090a0b0c0d0e0f10","parent_id":"0807060504030201","transaction_id":"0807060504030201","name":"SELECT users","context":{"service":{"target":{"type":"postgresql","name":"customers"}}}}}`,
+			expected: `{"span":{"id":"0102030405060708","trace_id":"0102030405060708090a0b0c0d0e0f10","parent_id":"0807060504030201","transaction_id":"0807060504030201","name":"SELECT users","context":{"service":{"target":{"type":"postgresql","name":"customers"}}}}}`,
+		},
+		"truncate messages": {
+			rules:    SpanRules{MaxStringLength: 4},
+			event:    `{"error":{"id":"0102030405060708","exception":{"message":"boom boom"},"log":{"message":"bang bang"}}}`,
+			expected: `{"error":{"id":"0102030405060708","exception":{"message":"boom"},"log":{"message":"bang"}}}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch(10, time.Hour, WithSpanRules(tc.rules))
+			b.RegisterInvocation("test", "arn", 500, time.Now())
+			require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + tc.event)}))
+
+			data := string(b.ToAPMData()[0].Data)
+			if tc.expected == "" {
+				assert.Equal(t, 0, b.Count())
+				assert.Equal(t, metadata, data)
+				return
+			}
+			assert.Equal(t, 1, b.Count())
+			assert.Equal(t, metadata+"\n"+tc.expected, data)
+		})
+	}
+}
+
+func TestSpanRulesDroppedParent(t *testing.T) {
+	b := NewBatch(10, time.Hour, WithSpanRules(SpanRules{DropNames: []string{"middleware *"}}))
+	b.RegisterInvocation("test", "arn", 500, time.Now())
+	events := []string{
+		`{"span":{"id":"03","parent_id":"02","transaction_id":"01","name":"SELECT"}}`,
+		`{"span":{"id":"04","parent_id":"03","transaction_id":"01","name":"middleware inner"}}`,
+		`{"span":{"id":"02","parent_id":"01","transaction_id":"01","name":"middleware outer"}}`,
+		`{"transaction":{"id":"01","span_count":{"started":3,"dropped":1}}}`,
+	}
+	require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + strings.Join(events, "\n"))}))
+
+	// The children of the dropped spans are re-parented to their closest
+	// kept ancestor, and the dropped spans are counted by the transaction.
+	expected := []string{
+		`{"span":{"id":"03","parent_id":"01","transaction_id":"01","name":"SELECT"}}`,
+		`{"transaction":{"id":"01","span_count":{"started":3,"dropped":3}}}`,
+	}
+	assert.Equal(t, 2, b.Count())
+	assert.Equal(t, metadata+"\n"+strings.Join(expected, "\n"), string(b.ToAPMData()[0].Data))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 3))
+	assert.Equal(t, "ab", truncate("abc", 2))
+	assert.Equal(t, "a", truncate("aé", 2))
+	assert.Equal(t, strings.Repeat("é", 2), truncate(strings.Repeat("é", 3), 5))
+}
@@ -0,0 +1,184 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// DefaultTransactionMetricsInterval is the default interval at which the
+// aggregated transaction metrics are added to the batch.
+const DefaultTransactionMetricsInterval time.Duration = time.Minute
+
+// TransactionMetrics configures the aggregation of the agent transactions
+// into transaction.duration.histogram metricsets.
+type TransactionMetrics struct {
+	// Interval is the interval at which the aggregates are added to the
+	// batch. They are also added on shutdown.
+	Interval time.Duration
+	// DropUnsampled drops the unsampled transactions once aggregated.
+	DropUnsampled bool
+}
+
+// WithTransactionMetrics aggregates the durations of the transactions
+// received from the agents, grouped by transaction name, type, outcome
+// and function.
+func WithTransactionMetrics(cfg TransactionMetrics) BatchOption {
+	return func(b *Batch) {
+		b.txnMetrics = newTxnAggregator(cfg)
+	}
+}
+
+// txnGroup identifies the transactions aggregated together.
+type txnGroup struct {
+	// metadata is the metadata line the transactions were received with.
+	metadata    string
+	name        string
+	typ         string
+	outcome     string
+	faasID      string
+	faasName    string
+	faasVersion string
+	triggerType string
+	coldstart   bool
+}
+
+type txnAggregator struct {
+	cfg TransactionMetrics
+	// histograms holds the count of the transaction durations, in
+	// microseconds rounded to two significant figures, of each group.
+	histograms map[txnGroup]map[float64]uint64
+	// groups holds the groups in the order they were first seen.
+	groups  []txnGroup
+	started time.Time
+}
+
+func newTxnAggregator(cfg TransactionMetrics) *txnAggregator {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultTransactionMetricsInterval
+	}
+	return &txnAggregator{
+		cfg:        cfg,
+		histograms: make(map[txnGroup]map[float64]uint64),
+		started:    time.Now(),
+	}
+}
+
+// aggregate records the duration of a transaction event received with the
+// metadata. It returns false if the event must be dropped.
+func (a *txnAggregator) aggregate(metadata string, data []byte) bool {
+	txn := gjson.GetBytes(data, "transaction")
+	group := txnGroup{
+		metadata:    metadata,
+		name:        txn.Get("name").Str,
+		typ:         txn.Get("type").Str,
+		outcome:     txn.Get("outcome").Str,
+		faasID:      txn.Get("faas.id").Str,
+		faasName:    txn.Get("faas.name").Str,
+		faasVersion: txn.Get("faas.version").Str,
+		triggerType: txn.Get("faas.trigger.type").Str,
+		coldstart:   txn.Get("faas.coldstart").Bool(),
+	}
+	h, ok := a.histograms[group]
+	if !ok {
+		h = make(map[float64]uint64)
+		a.histograms[group] = h
+		a.groups = append(a.groups, group)
+	}
+	h[roundSignificant(txn.Get("duration").Float()*1000, 2)]++
+
+	sampled := txn.Get("sampled")
+	return !a.cfg.DropUnsampled || !sampled.Exists() || sampled.Bool()
+}
+
+// due returns true if the aggregates must be added to the batch.
+func (a *txnAggregator) due() bool {
+	return len(a.groups) > 0 && time.Since(a.started) >= a.cfg.Interval
+}
+
+// metricset returns the metricset of the aggregates of a group.
+func (a *txnAggregator) metricset(group txnGroup, timestamp time.Time) ([]byte, error) {
+	metrics := model.Metrics{
+		Timestamp:   model.Time(timestamp),
+		Transaction: model.MetricsTransaction{Name: group.name, Type: group.typ},
+		Samples: map[string]model.Metric{
+			"transaction.duration.histogram": histogram(a.histograms[group]),
+		},
+	}
+	if group.outcome != "" {
+		metrics.Labels = model.StringMap{{Key: "transaction_outcome", Value: group.outcome}}
+	}
+	if group.faasID != "" || group.faasName != "" {
+		metrics.FAAS = &model.FAAS{
+			ID:        group.faasID,
+			Name:      group.faasName,
+			Version:   group.faasVersion,
+			Coldstart: group.coldstart,
+		}
+		if group.triggerType != "" {
+			metrics.FAAS.Trigger = &model.FAASTrigger{Type: group.triggerType}
+		}
+	}
+
+	var w fastjson.Writer
+	w.RawString(`{"metricset":`)
+	if err := metrics.MarshalFastJSON(&w); err != nil {
+		return nil, err
+	}
+	w.RawByte('}')
+	return w.Bytes(), nil
+}
+
+// reset resets the aggregation.
+func (a *txnAggregator) reset() {
+	a.histograms = make(map[txnGroup]map[float64]uint64)
+	a.groups = nil
+	a.started = time.Now()
+}
+
+// histogram returns the histogram metric of the counts, sorted by value.
+func histogram(counts map[float64]uint64) model.Metric {
+	m := model.Metric{
+		Type:   "histogram",
+		Values: make([]float64, 0, len(counts)),
+		Counts: make([]uint64, 0, len(counts)),
+	}
+	for v := range counts {
+		m.Values = append(m.Values, v)
+	}
+	sort.Float64s(m.Values)
+	for _, v := range m.Values {
+		m.Counts = append(m.Counts, counts[v])
+	}
+	return m
+}
+
+// roundSignificant rounds v to n significant figures.
+func roundSignificant(v float64, n int) float64 {
+	if v <= 0 {
+		return 0
+	}
+	scale := math.Pow(10, float64(n)-math.Ceil(math.Log10(v)))
+	return math.Round(v*scale) / scale
+}
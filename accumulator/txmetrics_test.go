@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package accumulator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionMetrics(t *testing.T) {
+	faas := `"faas":{"id":"arn","name":"fn","version":"$LATEST","coldstart":false,"trigger":{"type":"http"}}`
+	events := []string{
+		`{"transaction":{"id":"1","name":"GET /","type":"request","outcome":"success","duration":12.3,"sampled":true,` + faas + `}}`,
+		`{"transaction":{"id":"2","name":"GET /","type":"request","outcome":"success","duration":12.4,"sampled":false,` + faas + `}}`,
+		`{"transaction":{"id":"3","name":"GET /","type":"request","outcome":"success","duration":150,"sampled":false,` + faas + `}}`,
+		`{"transaction":{"id":"4","name":"GET /","type":"request","outcome":"failure","duration":5,"sampled":false,` + faas + `}}`,
+		`{"transaction":{"id":"5","name":"GET /","type":"request","outcome":"failure","duration":6,` + faas + `}}`,
+		`{"span":{"id":"5"}}`,
+	}
+
+	for name, tc := range map[string]struct {
+		dropUnsampled bool
+		expectedCount int
+	}{
+		"keep unsampled": {expectedCount: 6},
+		"drop unsampled": {dropUnsampled: true, expectedCount: 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewBatch(10, time.Hour, WithTransactionMetrics(TransactionMetrics{Interval: time.Hour, DropUnsampled: tc.dropUnsampled}))
+			b.RegisterInvocation("test", "arn", 500, time.Now())
+			require.NoError(t, b.AddAgentData(APMData{Data: []byte(metadata + "\n" + strings.Join(events, "\n"))}))
+
+			// The metrics are not added before the interval elapses.
+			require.NoError(t, b.AddTransactionMetrics())
+			assert.Equal(t, tc.expectedCount, b.Count())
+			b.Reset()
+
+			// The metrics of all the transactions are added on shutdown.
+			require.NoError(t, b.OnShutdown("timeout"))
+			lines := strings.Split(string(b.ToAPMData()[0].Data), "\n")
+			require.Len(t, lines, 3)
+			assert.Contains(t, lines[1], `"transaction":{"name":"GET /","type":"request"}`)
+			assert.Contains(t, lines[1], `"tags":{"transaction_outcome":"success"}`)
+			assert.Contains(t, lines[1], `"faas":{"coldstart":false,"id":"arn","name":"fn","trigger":{"type":"http"},"version":"$LATEST"}`)
+			assert.Contains(t, lines[1], `"transaction.duration.histogram":{"values":[12000,150000],"counts":[2,1],"type":"histogram"}`)
+			assert.Contains(t, lines[2], `"tags":{"transaction_outcome":"failure"}`)
+			assert.Contains(t, lines[2], `"transaction.duration.histogram":{"values":[5000,6000],"counts":[1,1],"type":"histogram"}`)
+
+			// The aggregation starts over.
+			b.Reset()
+			require.NoError(t, b.OnShutdown("timeout"))
+			assert.Equal(t, 0, b.Count())
+		})
+	}
+}
+
+func TestRoundSignificant(t *testing.T) {
+	for v, expected := range map[float64]float64{
+		0:      0,
+		1:      1,
+		12345:  12000,
+		12500:  13000,
+		987654: 990000,
+		0.0123: 0.012,
+	} {
+		assert.InDelta(t, expected, roundSignificant(v, 2), 1e-9, "%v", v)
+	}
+}
@@ -33,8 +33,11 @@ import (
 	"github.com/elastic/apm-aws-lambda/accumulator"
 )
 
+const intakeEndpointURI = "intake/v2/events"
+
 type jsonResult struct {
-	Errors []jsonError `json:"errors,omitempty"`
+	Accepted int         `json:"accepted"`
+	Errors   []jsonError `json:"errors,omitempty"`
 }
 
 type jsonError struct {
@@ -50,6 +53,14 @@ func (c *Client) ForwardApmData(ctx context.Context) error {
 		c.logger.Warn("Failed to start APM data forwarder due to client unhealthy")
 		return nil
 	}
+	// The requests in flight when the invocation completes are not
+	// cancelled, they are only bound to the invocation deadline.
+	sendCtx := context.Background()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithDeadline(sendCtx, deadline)
+		defer cancel()
+	}
 	var lambdaDataChan chan []byte
 	for {
 		select {
@@ -57,14 +68,14 @@ func (c *Client) ForwardApmData(ctx context.Context) error {
 			c.logger.Debug("Invocation context cancelled, not processing any more agent data")
 			return nil
 		case data := <-c.AgentDataChannel:
-			if err := c.forwardAgentData(ctx, data); err != nil {
+			if err := c.forwardAgentData(sendCtx, data); err != nil {
 				return err
 			}
 			// Wait for metadata to be available, metadata will be available as soon as
 			// the first agent data is processed.
 			lambdaDataChan = c.LambdaDataChannel
 		case data := <-lambdaDataChan:
-			if err := c.forwardLambdaData(ctx, data); err != nil {
+			if err := c.forwardLambdaData(sendCtx, data); err != nil {
 				return err
 			}
 		}
@@ -73,7 +84,9 @@ func (c *Client) ForwardApmData(ctx context.Context) error {
 
 // FlushAPMData reads all the apm data in the apm data channel and sends it to the APM server.
 func (c *Client) FlushAPMData(ctx context.Context) {
-	if c.IsUnhealthy() {
+	// With a spill queue configured the data is still processed while the
+	// transport is failing so that it can be persisted for a later replay.
+	if c.IsUnhealthy() && c.spill == nil {
 		c.logger.Debug("Flush skipped - Transport failing")
 		return
 	}
@@ -105,10 +118,21 @@ func (c *Client) FlushAPMData(ctx context.Context) {
 			c.logger.Debug("Failed to flush completely, may result in data drop")
 			return
 		default:
+			// Report the events rejected by APM Server so far, and
+			// the telemetry of the extension, along with the remaining
+			// data.
+			c.addIntakeMetrics()
+			c.addTelemetryMetrics()
+			if err := c.batch.AddTransactionMetrics(); err != nil {
+				c.logger.Warnf("Failed to add aggregated transaction metrics: %v", err)
+			}
 			// Flush any remaining data in batch
 			if err := c.sendBatch(ctx); err != nil {
 				c.logger.Errorf("Error sending to APM server, skipping: %v", err)
 			}
+			if err := c.CloseStream(ctx); err != nil {
+				c.logger.Errorf("Error closing intake stream to APM server: %v", err)
+			}
 			c.logger.Debug("Flush ended for lambda data - no data in buffer")
 			return
 		}
@@ -121,18 +145,19 @@ func (c *Client) FlushAPMData(ctx context.Context) {
 // It sets the APM transport status to failing upon errors, as part of the backoff
 // strategy.
 func (c *Client) PostToApmServer(ctx context.Context, apmData accumulator.APMData) error {
-	// todo: can this be a streaming or streaming style call that keeps the
-	//       connection open across invocations?
 	if c.IsUnhealthy() {
 		return errors.New("transport status is unhealthy")
 	}
 
-	endpointURI := "intake/v2/events"
+	if c.otlpOutput != nil {
+		return c.postOTLP(ctx, apmData)
+	}
+
 	encoding := apmData.ContentEncoding
 
-	var r io.Reader
+	var body []byte
 	if apmData.ContentEncoding != "" {
-		r = bytes.NewReader(apmData.Data)
+		body = apmData.Data
 	} else {
 		encoding = "gzip"
 		buf := c.bufferPool.Get().(*bytes.Buffer)
@@ -150,88 +175,214 @@ func (c *Client) PostToApmServer(ctx context.Context, apmData accumulator.APMDat
 		if err := gw.Close(); err != nil {
 			return fmt.Errorf("failed to write compressed data to buffer: %w", err)
 		}
-		r = buf
+		body = buf.Bytes()
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.serverURL+endpointURI, r)
-	if err != nil {
-		return fmt.Errorf("failed to create a new request when posting to APM server: %v", err)
+	events := countEvents(apmData)
+	if apmData.ContentEncoding != "" {
+		data, err := accumulator.GetUncompressedBytes(apmData.Data, apmData.ContentEncoding)
+		if err != nil {
+			return fmt.Errorf("failed to decompress data: %w", err)
+		}
+		events = countEvents(accumulator.APMData{Data: data})
 	}
-	req.Header.Add("Content-Encoding", encoding)
-	req.Header.Add("Content-Type", "application/x-ndjson")
-	if c.ServerAPIKey != "" {
-		req.Header.Add("Authorization", "ApiKey "+c.ServerAPIKey)
-	} else if c.ServerSecretToken != "" {
-		req.Header.Add("Authorization", "Bearer "+c.ServerSecretToken)
+
+	return c.postToEndpoints(func(e *endpoint) error {
+		return c.postToEndpoint(ctx, e, body, encoding, events)
+	})
+}
+
+// postToEndpoints posts data to all the endpoints whose transport is not
+// failing in fanout mode, or to the active endpoint otherwise. In failover
+// mode the data is posted to the next endpoint if the active one fails.
+func (c *Client) postToEndpoints(post func(e *endpoint) error) error {
+	if c.endpointMode == Fanout {
+		var lastErr error
+		for _, e := range c.endpoints {
+			if c.isFailing(e) {
+				c.logger.Debugf("Skipping APM server %s - Transport failing", e.serverURL)
+				continue
+			}
+			if err := post(e); err != nil {
+				c.logger.Warnf("Failed to send data to APM server %s: %v", e.serverURL, err)
+				lastErr = err
+			}
+		}
+		// Refresh the active endpoint as the status of the endpoints
+		// might have changed.
+		c.activeEndpoint()
+		return lastErr
+	}
+
+	var err error
+	for i := range c.endpoints {
+		e, ok := c.activeEndpoint()
+		if !ok {
+			if i == 0 {
+				return errors.New("transport status is unhealthy")
+			}
+			break
+		}
+		if i > 0 {
+			c.logger.Warnf("Failing over to APM server %s", e.serverURL)
+		}
+		if err = post(e); !c.isFailing(e) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) postToEndpoint(ctx context.Context, e *endpoint, body []byte, encoding string, events int) error {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.serverURL+intakeEndpointURI, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		c.setIntakeHeaders(req, encoding)
+		return req, nil
 	}
+	return c.doWithRetry(ctx, e, newRequest, func(ctx context.Context, e *endpoint, resp *http.Response) {
+		c.handleIntakeResponse(ctx, e, resp, events)
+	})
+}
 
-	c.logger.Debug("Sending data chunk to APM server")
-	resp, err := c.client.Do(req)
+// doWithRetry sends the requests created by newRequest to the endpoint,
+// retrying transient failures, and passes the final response to
+// handleResponse.
+func (c *Client) doWithRetry(
+	ctx context.Context,
+	e *endpoint,
+	newRequest func() (*http.Request, error),
+	handleResponse func(ctx context.Context, e *endpoint, resp *http.Response),
+) error {
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 1; ; attempt++ {
+		req, reqErr := newRequest()
+		if reqErr != nil {
+			return fmt.Errorf("failed to create a new request when posting to APM server: %v", reqErr)
+		}
+
+		c.logger.Debug("Sending data chunk to APM server")
+		start := time.Now()
+		resp, err = c.client.Do(req)
+		c.recordRequest(time.Since(start))
+		if err == nil && req.ContentLength > 0 {
+			c.recordBytesSent(req.ContentLength)
+		}
+		delay, retry := c.retryDelay(ctx, attempt, resp, err)
+		if !retry {
+			break
+		}
+		if err != nil {
+			c.logger.Debugf("Retrying request to APM server in %s after error: %v", delay, err)
+		} else {
+			c.logger.Debugf("Retrying request to APM server in %s after response status code: %d", delay, resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to post to APM server: %w", ctx.Err())
+		}
+	}
 	if err != nil {
-		c.UpdateStatus(ctx, Failing)
+		c.updateStatus(ctx, e, Failing)
 		return fmt.Errorf("failed to post to APM server: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// On success, the server will respond with a 202 Accepted status code and no body.
-	if resp.StatusCode == http.StatusAccepted {
-		c.UpdateStatus(ctx, Healthy)
-		return nil
+	handleResponse(ctx, e, resp)
+	return nil
+}
+
+func (c *Client) setIntakeHeaders(req *http.Request, encoding string) {
+	c.setCustomHeaders(req)
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	c.setAuthHeader(req)
+}
+
+func (c *Client) setAuthHeader(req *http.Request) {
+	if c.ServerAPIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.ServerAPIKey)
+	} else if c.ServerSecretToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.ServerSecretToken)
 	}
+}
 
-	// RateLimited
-	if resp.StatusCode == http.StatusTooManyRequests {
-		c.logger.Warnf("Transport has been rate limited: response status code: %d", resp.StatusCode)
-		c.UpdateStatus(ctx, RateLimited)
-		return nil
+// handleIntakeResponse updates the status of the endpoint's transport based
+// on the response to an intake request of the given number of events.
+func (c *Client) handleIntakeResponse(ctx context.Context, e *endpoint, resp *http.Response, events int) {
+	// On success, the server will respond with a 202 Accepted status code and no body.
+	if resp.StatusCode == http.StatusAccepted {
+		c.recordIntakeResult(resp.StatusCode, jsonResult{Accepted: events}, "")
+		c.updateStatus(ctx, e, Healthy)
+		return
 	}
 
-	jErr := jsonResult{}
-	if err := json.NewDecoder(resp.Body).Decode(&jErr); err != nil {
+	// The body holds the number of accepted events, if any, along
+	// with the errors for the rejected ones.
+	result := jsonResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
 		// non critical error.
 		// Log a warning and continue.
 		c.logger.Warnf("failed to decode response body: %v", err)
 	}
 
+	// RateLimited
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.logger.Warnf("Transport has been rate limited: response status code: %d", resp.StatusCode)
+		c.recordIntakeResult(resp.StatusCode, result, "rate limited")
+		c.updateStatus(ctx, e, RateLimited)
+		return
+	}
+
 	// Auth errors
 	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
 		c.logger.Warnf("Authentication with the APM server failed: response status code: %d", resp.StatusCode)
-		for _, err := range jErr.Errors {
-			c.logger.Warnf("failed to authenticate: document %s: message: %s", err.Document, err.Message)
-		}
-		c.UpdateStatus(ctx, Failing)
-		return nil
+		c.recordIntakeResult(resp.StatusCode, result, "failed to authenticate")
+		c.updateStatus(ctx, e, Failing)
+		return
 	}
 
 	// ClientErrors
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		c.logger.Warnf("client error: response status code: %d", resp.StatusCode)
-		for _, err := range jErr.Errors {
-			c.logger.Warnf("client error: document %s: message: %s", err.Document, err.Message)
-		}
-		c.UpdateStatus(ctx, ClientFailing)
-		return nil
+		c.logger.Warnf("client error: response status code: %d: %d events accepted, %d rejected", resp.StatusCode, result.Accepted, len(result.Errors))
+		c.recordIntakeResult(resp.StatusCode, result, "client error")
+		c.updateStatus(ctx, e, ClientFailing)
+		return
 	}
 
 	// critical errors
 	if resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == http.StatusServiceUnavailable {
 		c.logger.Warnf("failed to post data to APM server: response status code: %d", resp.StatusCode)
-		for _, err := range jErr.Errors {
-			c.logger.Warnf("critical error: document %s: message: %s", err.Document, err.Message)
-		}
-		c.UpdateStatus(ctx, Failing)
-		return nil
+		c.recordIntakeResult(resp.StatusCode, result, "critical error")
+		c.updateStatus(ctx, e, Failing)
+		return
 	}
 
 	c.logger.Warnf("unhandled status code: %d", resp.StatusCode)
-	return nil
 }
 
-// IsUnhealthy returns true if the apmproxy is not healthy.
+// IsUnhealthy returns true if the apmproxy is not healthy, i.e. the
+// transport to every APM Server endpoint is failing.
 func (c *Client) IsUnhealthy() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.Status == Failing
+	for _, e := range c.endpoints {
+		if e.Status != Failing {
+			return false
+		}
+	}
+	return true
 }
 
 // UpdateStatus takes a state of the APM server transport and updates
@@ -240,12 +391,20 @@ func (c *Client) IsUnhealthy() bool {
 // before changing the status to "pending". This would allow a subsequent send attempt
 // to the APM server.
 //
-// This function is public for use in tests.
+// The status is updated for the currently active endpoint. This function is public
+// for use in tests.
 func (c *Client) UpdateStatus(ctx context.Context, status Status) {
-	// Reduce lock contention as UpdateStatus is called on every
+	c.mu.RLock()
+	e := c.endpoint
+	c.mu.RUnlock()
+	c.updateStatus(ctx, e, status)
+}
+
+func (c *Client) updateStatus(ctx context.Context, e *endpoint, status Status) {
+	// Reduce lock contention as updateStatus is called on every
 	// successful request
 	c.mu.RLock()
-	if status == c.Status {
+	if status == e.Status {
 		c.mu.RUnlock()
 		return
 	}
@@ -254,40 +413,52 @@ func (c *Client) UpdateStatus(ctx context.Context, status Status) {
 	switch status {
 	case Healthy:
 		c.mu.Lock()
-		if c.Status == status {
+		if e.Status == status {
+			c.mu.Unlock()
 			return
 		}
-		c.Status = status
-		c.logger.Debugf("APM server Transport status set to %s", c.Status)
-		c.ReconnectionCount = -1
+		e.Status = status
+		c.logger.Debugf("APM server %s Transport status set to %s", e.serverURL, e.Status)
+		e.ReconnectionCount = -1
 		c.mu.Unlock()
+		c.recordTransition(status)
 	case RateLimited, ClientFailing:
 		// No need to start backoff, this is a temporary status. It usually
 		// means we went over the limit of events/s.
 		c.mu.Lock()
-		c.Status = status
-		c.logger.Debugf("APM server Transport status set to %s", c.Status)
+		e.Status = status
+		c.logger.Debugf("APM server %s Transport status set to %s", e.serverURL, e.Status)
 		c.mu.Unlock()
+		c.recordTransition(status)
 	case Failing:
 		c.mu.Lock()
-		c.Status = status
-		c.logger.Debugf("APM server Transport status set to %s", c.Status)
-		c.ReconnectionCount++
-		gracePeriodTimer := time.NewTimer(c.ComputeGracePeriod())
-		c.logger.Debugf("Grace period entered, reconnection count : %d", c.ReconnectionCount)
+		e.Status = status
+		c.logger.Debugf("APM server %s Transport status set to %s", e.serverURL, e.Status)
+		e.ReconnectionCount++
+		gracePeriod := computeGracePeriod(e.ReconnectionCount)
+		gracePeriodTimer := time.NewTimer(gracePeriod)
+		e.gracePeriodEnd = time.Now().Add(gracePeriod)
+		c.logger.Debugf("Grace period entered, reconnection count : %d", e.ReconnectionCount)
 		c.mu.Unlock()
+		c.recordTransition(status)
 
+		c.gracePeriods.Add(1)
 		go func() {
+			defer c.gracePeriods.Done()
 			select {
 			case <-gracePeriodTimer.C:
 				c.logger.Debug("Grace period over - timer timed out")
 			case <-ctx.Done():
 				c.logger.Debug("Grace period over - context done")
+			case <-c.done:
+				gracePeriodTimer.Stop()
+				return
 			}
 			c.mu.Lock()
-			c.Status = Started
-			c.logger.Debugf("APM server Transport status set to %s", c.Status)
+			e.Status = Started
+			c.logger.Debugf("APM server %s Transport status set to %s", e.serverURL, e.Status)
 			c.mu.Unlock()
+			c.recordTransition(Started)
 		}()
 	default:
 		c.logger.Errorf("Cannot set APM server Transport status to %s", status)
@@ -296,14 +467,18 @@ func (c *Client) UpdateStatus(ctx context.Context, status Status) {
 
 // ComputeGracePeriod https://github.com/elastic/apm/blob/main/specs/agents/transport.md#transport-errors
 func (c *Client) ComputeGracePeriod() time.Duration {
+	return computeGracePeriod(c.ReconnectionCount)
+}
+
+func computeGracePeriod(reconnectionCount int) time.Duration {
 	// If reconnectionCount is 0, returns a random number in an interval.
 	// The grace period for the first reconnection count was 0 but that
 	// leads to collisions with multiple environments.
-	if c.ReconnectionCount == 0 {
+	if reconnectionCount == 0 {
 		gracePeriod := rand.Float64() * 5
 		return time.Duration(gracePeriod * float64(time.Second))
 	}
-	gracePeriodWithoutJitter := math.Pow(math.Min(float64(c.ReconnectionCount), 6), 2)
+	gracePeriodWithoutJitter := math.Pow(math.Min(float64(reconnectionCount), 6), 2)
 	jitter := rand.Float64()/5 - 0.1
 	return time.Duration((gracePeriodWithoutJitter + jitter*gracePeriodWithoutJitter) * float64(time.Second))
 }
@@ -333,8 +508,9 @@ func (c *Client) WaitForFlush() <-chan struct{} {
 func (c *Client) forwardAgentData(ctx context.Context, apmData accumulator.APMData) error {
 	if err := c.batch.AddAgentData(apmData); err != nil {
 		c.logger.Warnf("Dropping agent data due to error: %v", err)
+		c.recordBatchError(err, countEvents(apmData))
 	}
-	if c.batch.ShouldShip() {
+	if c.streaming || c.batch.ShouldShip() {
 		return c.sendBatch(ctx)
 	}
 	return nil
@@ -343,17 +519,137 @@ func (c *Client) forwardAgentData(ctx context.Context, apmData accumulator.APMDa
 func (c *Client) forwardLambdaData(ctx context.Context, data []byte) error {
 	if err := c.batch.AddLambdaData(data); err != nil {
 		c.logger.Warnf("Dropping lambda data due to error: %v", err)
+		c.recordBatchError(err, 1)
 	}
-	if c.batch.ShouldShip() {
+	if c.streaming || c.batch.ShouldShip() {
 		return c.sendBatch(ctx)
 	}
 	return nil
 }
 
 func (c *Client) sendBatch(ctx context.Context) error {
+	// Replay previously undelivered batches first to preserve ordering.
+	c.replaySpilled(ctx)
+	if c.streaming {
+		return c.streamBatch(ctx)
+	}
 	if c.batch == nil || c.batch.Count() == 0 {
 		return nil
 	}
 	defer c.batch.Reset()
-	return c.PostToApmServer(ctx, c.batch.ToAPMData())
+	// Each distinct metadata is shipped in its own request.
+	var firstErr error
+	for _, data := range c.batch.ToAPMData() {
+		if data.Count == 0 {
+			continue
+		}
+		for _, data := range c.deliveryBatches(data) {
+			err := c.PostToApmServer(ctx, data.APMData)
+			if err != nil || !c.isDelivered() {
+				c.spillData(data.APMData)
+			} else {
+				c.recordForwarded(data.Count)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// deliveryBatches splits the data of a batch into the parts that are each
+// delivered, or spilled on failure, as a whole. The OTLP signals are
+// exported by separate requests, each is split into its own part so that
+// the accepted signals are not sent again when a failed one is replayed.
+func (c *Client) deliveryBatches(data accumulator.BatchData) []accumulator.BatchData {
+	if c.otlpOutput == nil {
+		return []accumulator.BatchData{data}
+	}
+	split, err := splitOTLPSignals(data)
+	if err != nil {
+		// Posting the data as a whole reports the error.
+		return []accumulator.BatchData{data}
+	}
+	return split
+}
+
+// recordBatchError records the events dropped as they could not be added
+// to the batch.
+func (c *Client) recordBatchError(err error, n int) {
+	var tooLarge *accumulator.TooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.recordDropped(DroppedEventTooLarge, tooLarge.Dropped)
+	case errors.Is(err, accumulator.ErrEventTooLarge):
+		c.recordDropped(DroppedEventTooLarge, n)
+	case errors.Is(err, accumulator.ErrBatchFull):
+		c.recordDropped(DroppedBatchFull, n)
+	case errors.Is(err, accumulator.ErrMetadataUnavailable):
+		c.recordDropped(DroppedMetadataUnavailable, n)
+	}
+}
+
+// isDelivered returns false if the status of the transport indicates that
+// the last request to APM Server did not go through and is worth retrying.
+func (c *Client) isDelivered() bool {
+	c.mu.RLock()
+	e := c.endpoint
+	c.mu.RUnlock()
+	return c.isEndpointDelivered(e)
+}
+
+func (c *Client) isEndpointDelivered(e *endpoint) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return e.Status != Failing && e.Status != RateLimited
+}
+
+func (c *Client) spillData(apmData accumulator.APMData) {
+	if c.spill == nil {
+		return
+	}
+	evicted, err := c.spill.Push(apmData)
+	if err != nil {
+		c.logger.Warnf("Failed to spill undelivered batch to disk, dropping: %v", err)
+		return
+	}
+	if evicted > 0 {
+		c.logger.Warnf("Spill queue full: dropped %d oldest undelivered batches", evicted)
+	}
+	c.logger.Debugf("Spilled undelivered batch to disk, %d batches pending replay", c.spill.Len())
+}
+
+// replaySpilled sends the batches persisted in the spill queue, oldest
+// first, as long as the transport is in a state that allows sending.
+func (c *Client) replaySpilled(ctx context.Context) {
+	if c.spill == nil {
+		return
+	}
+	for c.spill.Len() > 0 {
+		e, _ := c.activeEndpoint()
+		c.mu.RLock()
+		status := e.Status
+		c.mu.RUnlock()
+		if status != Started && status != Healthy {
+			return
+		}
+		apmData, err := c.spill.Peek()
+		if err != nil {
+			c.logger.Warnf("Dropping unreadable spilled batch: %v", err)
+		} else {
+			if err := c.PostToApmServer(ctx, apmData); err != nil {
+				c.logger.Warnf("Failed to replay spilled batch: %v", err)
+				return
+			}
+			if !c.isDelivered() {
+				return
+			}
+			c.logger.Debug("Replayed spilled batch to APM server")
+		}
+		if err := c.spill.Pop(); err != nil {
+			c.logger.Warnf("Failed to remove replayed batch from spill queue: %v", err)
+			return
+		}
+	}
 }
@@ -25,6 +25,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -35,8 +36,11 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestPostToApmServerDataCompressed(t *testing.T) {
@@ -591,6 +595,190 @@ func TestContinuedAPMServerFailure(t *testing.T) {
 	assert.Equal(t, apmClient.Status, apmproxy.Failing)
 }
 
+func TestPostToApmServerRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		maxAttempts      int
+		failures         int32
+		retryAfter       string
+		maxBackoff       time.Duration
+		deadline         time.Duration
+		expectedRequests int32
+		expectedStatus   apmproxy.Status
+	}{
+		{
+			name:             "recovers_within_max_attempts",
+			maxAttempts:      3,
+			failures:         2,
+			expectedRequests: 3,
+			expectedStatus:   apmproxy.Healthy,
+		},
+		{
+			name:             "honors_retry_after",
+			maxAttempts:      2,
+			failures:         1,
+			retryAfter:       "0",
+			expectedRequests: 2,
+			expectedStatus:   apmproxy.Healthy,
+		},
+		{
+			name:             "exhausts_max_attempts",
+			maxAttempts:      2,
+			failures:         5,
+			expectedRequests: 2,
+			expectedStatus:   apmproxy.Failing,
+		},
+		{
+			name:             "caps_retry_after",
+			maxAttempts:      2,
+			failures:         1,
+			retryAfter:       "10",
+			deadline:         time.Second,
+			expectedRequests: 2,
+			expectedStatus:   apmproxy.Healthy,
+		},
+		{
+			name:             "retry_after_exceeds_deadline",
+			maxAttempts:      3,
+			failures:         1,
+			retryAfter:       "10",
+			maxBackoff:       time.Minute,
+			deadline:         time.Second,
+			expectedRequests: 1,
+			expectedStatus:   apmproxy.Failing,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) <= tc.failures {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer apmServer.Close()
+
+			maxBackoff := tc.maxBackoff
+			if maxBackoff == 0 {
+				maxBackoff = 10 * time.Millisecond
+			}
+			apmClient, err := apmproxy.NewClient(
+				apmproxy.WithURL(apmServer.URL),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+				apmproxy.WithRetryMaxAttempts(tc.maxAttempts),
+				apmproxy.WithRetryBackoff(time.Millisecond),
+				apmproxy.WithRetryMaxBackoff(maxBackoff),
+			)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, apmClient.Shutdown())
+			}()
+
+			ctx := context.Background()
+			if tc.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				defer cancel()
+			}
+			require.NoError(t, apmClient.PostToApmServer(ctx, accumulator.APMData{Data: []byte("{}")}))
+			assert.Equal(t, tc.expectedRequests, requests.Load())
+			assert.Equal(t, tc.expectedStatus, apmClient.Status)
+		})
+	}
+}
+
+func TestPostToApmServerDeadline(t *testing.T) {
+	done := make(chan struct{})
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	defer close(done)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Error(t, apmClient.PostToApmServer(ctx, accumulator.APMData{Data: []byte("{}")}))
+	// The in-flight request is cancelled at the deadline
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPostToApmServerFailover(t *testing.T) {
+	var primaryRequests, secondaryRequests atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryRequests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryRequests.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(primary.URL, secondary.URL),
+		apmproxy.WithEndpointMode(apmproxy.Failover),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// The data that the primary endpoint failed to accept is posted to
+	// the secondary one.
+	data := accumulator.APMData{Data: []byte("{}")}
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), data))
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+	assert.False(t, apmClient.IsUnhealthy())
+	assert.Equal(t, int32(1), primaryRequests.Load())
+	assert.Equal(t, int32(1), secondaryRequests.Load())
+
+	// The secondary endpoint is used while the primary is failing.
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), data))
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+	assert.Equal(t, int32(1), primaryRequests.Load())
+	assert.Equal(t, int32(2), secondaryRequests.Load())
+}
+
+func TestPostToApmServerFanout(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(first.URL, second.URL),
+		apmproxy.WithEndpointMode(apmproxy.Fanout),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte("{}")}))
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+}
+
 func TestForwardApmData(t *testing.T) {
 	receivedReqBodyChan := make(chan []byte)
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -661,6 +849,191 @@ func TestForwardApmData(t *testing.T) {
 	wg.Wait()
 }
 
+func TestSpillAndReplay(t *testing.T) {
+	var accept atomic.Bool
+	receivedReqBodyChan := make(chan []byte, 1)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accept.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	metadata := `{"metadata":{"service":{"name":"test"}}}`
+	agentData := fmt.Sprintf("%s\n%s", metadata, `{"transaction":{"id":"0102030405060708","trace_id":"0102030405060708090a0b0c0d0e0f10"}}`)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithSpillQueue(t.TempDir(), 1<<20),
+	)
+	require.NoError(t, err)
+
+	// The batch fails to be delivered and is spilled to disk.
+	ctx, cancel := context.WithCancel(context.Background())
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(agentData)}
+	apmClient.FlushAPMData(ctx)
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+
+	// Cancel the context to end the grace period.
+	cancel()
+	require.Eventually(t, func() bool {
+		return !apmClient.IsUnhealthy()
+	}, time.Second, 10*time.Millisecond)
+
+	// The spilled batch is replayed on the next flush.
+	accept.Store(true)
+	apmClient.FlushAPMData(context.Background())
+	var body []byte
+	select {
+	case body = <-receivedReqBodyChan:
+	case <-time.After(time.Second):
+		require.Fail(t, "mock APM-Server timed out waiting for request")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, agentData, string(out))
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+}
+
+func TestIntakeStream(t *testing.T) {
+	receivedReqBodyChan := make(chan []byte, 2)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	metadata := `{"metadata":{"service":{"name":"test"}}}`
+	txn := `{"transaction":{"id":"0102030405060708","trace_id":"0102030405060708090a0b0c0d0e0f10"}}`
+	lambdaData := `{"log":{"message":"test"}}`
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithIntakeStream(0, time.Minute),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(metadata + "\n" + txn)}
+		apmClient.LambdaDataChannel <- []byte(lambdaData)
+		apmClient.LambdaDataChannel <- []byte(lambdaData)
+		// Events are streamed in a single request which is completed on flush.
+		apmClient.FlushAPMData(context.Background())
+
+		select {
+		case body := <-receivedReqBodyChan:
+			if i == 0 {
+				assert.Equal(t, strings.Join([]string{metadata, txn, lambdaData, lambdaData}, "\n"), string(body))
+				break
+			}
+			// The events accepted with the previous stream are reported.
+			assert.True(t, strings.HasPrefix(string(body), strings.Join([]string{metadata, txn, lambdaData, lambdaData}, "\n")+"\n"))
+			assert.Contains(t, string(body), `"extension.intake.events.accepted":{"value":3}`)
+		case <-time.After(time.Second):
+			require.Fail(t, "mock APM-Server timed out waiting for request")
+		}
+		assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+	}
+}
+
+func TestIntakeStreamSpill(t *testing.T) {
+	var accept atomic.Bool
+	receivedReqBodyChan := make(chan []byte, 1)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		if !accept.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	metadata := `{"metadata":{"service":{"name":"test"}}}`
+	agentData := metadata + "\n" + `{"transaction":{"id":"0102030405060708","trace_id":"0102030405060708090a0b0c0d0e0f10"}}`
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithIntakeStream(0, time.Minute),
+		apmproxy.WithSpillQueue(t.TempDir(), 1<<20),
+		apmproxy.WithSelfTelemetry(true),
+	)
+	require.NoError(t, err)
+
+	// The events written to the stream are spilled once APM Server
+	// rejects the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(agentData)}
+	apmClient.FlushAPMData(ctx)
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+
+	// Cancel the context to end the grace period.
+	cancel()
+	require.Eventually(t, func() bool {
+		return !apmClient.IsUnhealthy()
+	}, time.Second, 10*time.Millisecond)
+
+	// The spilled events are replayed on the next flush, they were not
+	// reported as forwarded before.
+	accept.Store(true)
+	apmClient.FlushAPMData(context.Background())
+	select {
+	case body := <-receivedReqBodyChan:
+		assert.Equal(t, agentData, string(body))
+	case <-time.After(time.Second):
+		require.Fail(t, "mock APM-Server timed out waiting for request")
+	}
+	select {
+	case body := <-receivedReqBodyChan:
+		assert.Contains(t, string(body), `"extension.events.forwarded":{"value":0}`)
+	case <-time.After(time.Second):
+		require.Fail(t, "mock APM-Server timed out waiting for request")
+	}
+}
+
+func TestIntakeStreamMaxSize(t *testing.T) {
+	var requests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		requests.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		// Every write exceeds the max size and completes the stream.
+		apmproxy.WithIntakeStream(1, time.Minute),
+	)
+	require.NoError(t, err)
+
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(`{"metadata":{}}` + "\n" + `{"log":{}}`)}
+	apmClient.LambdaDataChannel <- []byte(`{"log":{}}`)
+	apmClient.FlushAPMData(context.Background())
+	// The intake metrics of the accepted events are streamed too.
+	assert.Equal(t, int32(3), requests.Load())
+}
+
 func BenchmarkFlushAPMData(b *testing.B) {
 	// Create apm server and handler
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -752,3 +1125,395 @@ func getReadyBatch(maxSize int, maxAge time.Duration) *accumulator.Batch {
 	batch.RegisterInvocation("test-req-id", "test-func-arn", 10_000, time.Now())
 	return batch
 }
+
+func TestMaxBytesPayloadDelivered(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		events   int
+	)
+	maxBytes := 64 * 1024
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(body), maxBytes)
+		mu.Lock()
+		requests++
+		events += bytes.Count(body, []byte(`{"log":`))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	batch := accumulator.NewBatch(10_000, time.Minute, accumulator.WithMaxBytes(maxBytes))
+	batch.RegisterInvocation("test-req-id", "test-func-arn", 10_000, time.Now())
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(batch),
+	)
+	require.NoError(t, err)
+
+	// A payload of about 4 times the max bytes is delivered in full.
+	event := `{"log":{"message":"` + strings.Repeat("a", 200) + `"}}`
+	payload := `{"metadata":{"service":{"name":"test"}}}` + strings.Repeat("\n"+event, 1000)
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(payload)}
+	apmClient.FlushAPMData(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Greater(t, requests, 1)
+	assert.Equal(t, 1000, events)
+}
+
+func TestPartialAcceptance(t *testing.T) {
+	receivedReqBodyChan := make(chan []byte, 2)
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		receivedReqBodyChan <- body
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, err = w.Write([]byte(`{"accepted":1,"errors":[` +
+			`{"message":"validation error: 'name' required","document":"{\"span\":{\"id\":\"1\"}}"},` +
+			`{"message":"event exceeded the permitted size.","document":"{\"error\":{\"id\":\"2\"}}"}]}`))
+		require.NoError(t, err)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	metadata := `{"metadata":{"service":{"name":"test"}}}`
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+	)
+	require.NoError(t, err)
+
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(metadata + "\n" + `{"span":{"id":"1"}}` + "\n" + `{"error":{"id":"2"}}`)}
+	apmClient.FlushAPMData(context.Background())
+	<-receivedReqBodyChan
+
+	assert.Equal(t, apmproxy.ClientFailing, apmClient.Status)
+	assert.Equal(t, apmproxy.IntakeStats{
+		Accepted: 1,
+		Rejected: map[string]int{
+			apmproxy.RejectedValidation: 1,
+			apmproxy.RejectedTooLarge:   1,
+		},
+	}, apmClient.IntakeStats())
+
+	// The rejections are reported with the next flush, and only once. The
+	// events accepted in full are reported too.
+	for i := 0; i < 2; i++ {
+		apmClient.LambdaDataChannel <- []byte(`{"log":{"message":"test"}}`)
+		apmClient.FlushAPMData(context.Background())
+		select {
+		case body := <-receivedReqBodyChan:
+			if i == 0 {
+				assert.Contains(t, string(body), `"extension.intake.events.accepted":{"value":1}`)
+				assert.Contains(t, string(body), `"extension.intake.events.rejected.validation":{"value":1}`)
+				assert.Contains(t, string(body), `"extension.intake.events.rejected.too_large":{"value":1}`)
+			} else {
+				assert.Contains(t, string(body), `"extension.intake.events.accepted":{"value":2}`)
+				assert.NotContains(t, string(body), "extension.intake.events.rejected")
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "mock APM-Server timed out waiting for request")
+		}
+	}
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+}
+
+func TestMultipleMetadata(t *testing.T) {
+	receivedReqBodyChan := make(chan []byte, 2)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+	)
+	require.NoError(t, err)
+
+	node := `{"metadata":{"service":{"name":"node"}}}`
+	python := `{"metadata":{"service":{"name":"python"}}}`
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(node + "\n" + `{"span":{"id":"1"}}`)}
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(python + "\n" + `{"span":{"id":"2"}}`)}
+	apmClient.FlushAPMData(context.Background())
+
+	// The events of each metadata are sent in their own request.
+	for _, expected := range []string{
+		node + "\n" + `{"span":{"id":"1"}}`,
+		python + "\n" + `{"span":{"id":"2"}}`,
+	} {
+		select {
+		case body := <-receivedReqBodyChan:
+			assert.Equal(t, expected, string(body))
+		case <-time.After(time.Second):
+			require.Fail(t, "mock APM-Server timed out waiting for request")
+		}
+	}
+}
+
+func TestSelfTelemetry(t *testing.T) {
+	receivedReqBodyChan := make(chan []byte, 2)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	var logsDropped int64
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithSelfTelemetry(true),
+		apmproxy.WithLogsAPIDropped(func() (int64, int64) {
+			return atomic.LoadInt64(&logsDropped), 10 * atomic.LoadInt64(&logsDropped)
+		}),
+	)
+	require.NoError(t, err)
+
+	metadata := `{"metadata":{"service":{"name":"test"}}}`
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(metadata + "\n" + `{"span":{"id":"1"}}` + "\n" + `{"error":{"id":"2"}}`)}
+	atomic.StoreInt64(&logsDropped, 3)
+	apmClient.RecordFlushTimeout()
+
+	// The first flush sends the agent data along with the telemetry
+	// accumulated so far, the second one the telemetry of the first.
+	for i := 0; i < 2; i++ {
+		apmClient.FlushAPMData(context.Background())
+		select {
+		case body := <-receivedReqBodyChan:
+			assert.Contains(t, string(body), `"tags":{"source":"apm-aws-lambda"}`)
+			if i == 0 {
+				assert.Contains(t, string(body), `"extension.flush.timeouts":{"value":1}`)
+				assert.Contains(t, string(body), `"extension.logs_api.dropped.records":{"value":3}`)
+				assert.Contains(t, string(body), `"extension.logs_api.dropped.bytes":{"value":30}`)
+				assert.Contains(t, string(body), `"extension.apm_server.request.count":{"value":0}`)
+			} else {
+				assert.Contains(t, string(body), `"extension.events.forwarded":{"value":3}`)
+				assert.Contains(t, string(body), `"extension.apm_server.request.count":{"value":1}`)
+				assert.Contains(t, string(body), `"extension.transport.transitions.Healthy":{"value":1}`)
+				assert.Contains(t, string(body), `"extension.flush.timeouts":{"value":0}`)
+				assert.Contains(t, string(body), `"extension.logs_api.dropped.records":{"value":0}`)
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "mock APM-Server timed out waiting for request")
+		}
+	}
+}
+
+func TestSelfTelemetryDrops(t *testing.T) {
+	receivedReqBodyChan := make(chan []byte, 1)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		receivedReqBodyChan <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithSelfTelemetry(true),
+	)
+	require.NoError(t, err)
+
+	// Lambda data is dropped until the metadata is available.
+	apmClient.LambdaDataChannel <- []byte(`{"log":{"message":"test"}}`)
+	apmClient.FlushAPMData(context.Background())
+	assert.Equal(t, map[string]int{apmproxy.DroppedMetadataUnavailable: 1}, apmClient.DroppedEvents())
+
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(`{"metadata":{"service":{"name":"test"}}}` + "\n" + `{"span":{"id":"1"}}`)}
+	apmClient.FlushAPMData(context.Background())
+	select {
+	case body := <-receivedReqBodyChan:
+		assert.Contains(t, string(body), `"extension.events.dropped.metadata_unavailable":{"value":1}`)
+	case <-time.After(time.Second):
+		require.Fail(t, "mock APM-Server timed out waiting for request")
+	}
+}
+
+func TestOTLPOutput(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]byte)
+	)
+	otlpEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Bearer collector", r.Header.Get("Authorization"))
+		assert.Equal(t, "tenant-a", r.Header.Get("X-Tenant"))
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		mu.Lock()
+		received[r.URL.Path] = body
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(otlpEndpoint.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(otlpEndpoint.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithSecretToken("not sent to the OTLP endpoint"),
+		apmproxy.WithHeaders(map[string]string{"X-Tenant": "tenant-a", "Content-Type": "text/plain"}),
+		apmproxy.WithOTLPOutput(map[string]string{"Authorization": "Bearer collector"}, ""),
+	)
+	require.NoError(t, err)
+
+	data := `{"metadata":{"service":{"name":"checkout","agent":{"name":"nodejs","version":"3.0.0"}}}}` + "\n" +
+		`{"transaction":{"id":"0102030405060708","trace_id":"5b8efef142334f5a9d3b112c2f3d4e5f","name":"GET /cart","type":"request","timestamp":1700000000000000,"duration":250,"outcome":"success"}}` + "\n" +
+		`{"log":{"message":"cart is empty","@timestamp":1700000000000000}}`
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte(data)}))
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 2)
+
+	var traces tracev1.TracesData
+	require.NoError(t, proto.Unmarshal(received["/v1/traces"], &traces))
+	require.Len(t, traces.ResourceSpans, 1)
+	assert.Equal(t, "checkout", traces.ResourceSpans[0].Resource.Attributes[0].Value.GetStringValue())
+	span := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "GET /cart", span.Name)
+	assert.Equal(t, tracev1.Span_SPAN_KIND_SERVER, span.Kind)
+	assert.Equal(t, uint64(250*time.Millisecond), span.EndTimeUnixNano-span.StartTimeUnixNano)
+
+	var logs logsv1.LogsData
+	require.NoError(t, proto.Unmarshal(received["/v1/logs"], &logs))
+	assert.Equal(t, "cart is empty", logs.ResourceLogs[0].ScopeLogs[0].LogRecords[0].Body.GetStringValue())
+}
+
+func TestOTLPOutputRejected(t *testing.T) {
+	otlpEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(otlpEndpoint.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(otlpEndpoint.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithOTLPOutput(nil, apmproxy.OTLPCompressionNone),
+	)
+	require.NoError(t, err)
+
+	data := `{"metadata":{"service":{"name":"checkout"}}}` + "\n" + `{"log":{"message":"test"}}`
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte(data)}))
+	assert.Equal(t, apmproxy.ClientFailing, apmClient.Status)
+
+	_, err = apmproxy.NewClient(
+		apmproxy.WithURL(otlpEndpoint.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithOTLPOutput(nil, "zstd"),
+	)
+	assert.Error(t, err)
+}
+
+func TestOTLPOutputSpill(t *testing.T) {
+	var (
+		accept   atomic.Bool
+		mu       sync.Mutex
+		received = make(map[string]int)
+	)
+	otlpEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/logs" && !accept.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		received[r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(otlpEndpoint.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(otlpEndpoint.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithBatch(getReadyBatch(100, time.Minute)),
+		apmproxy.WithOTLPOutput(nil, apmproxy.OTLPCompressionNone),
+		apmproxy.WithSpillQueue(t.TempDir(), 1<<20),
+	)
+	require.NoError(t, err)
+
+	data := `{"metadata":{"service":{"name":"checkout"}}}` + "\n" +
+		`{"transaction":{"id":"0102030405060708","trace_id":"5b8efef142334f5a9d3b112c2f3d4e5f","name":"GET /cart","type":"request","duration":250}}` + "\n" +
+		`{"log":{"message":"cart is empty"}}`
+	ctx, cancel := context.WithCancel(context.Background())
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(data)}
+	apmClient.FlushAPMData(ctx)
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+
+	// Cancel the context to end the grace period.
+	cancel()
+	require.Eventually(t, func() bool {
+		return !apmClient.IsUnhealthy()
+	}, time.Second, 10*time.Millisecond)
+
+	// Only the rejected signal is replayed.
+	accept.Store(true)
+	apmClient.FlushAPMData(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"/v1/traces": 1, "/v1/logs": 1}, received)
+}
+
+func TestCustomHeaders(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "tenant-a", r.Header.Get("X-Tenant"))
+		assert.Equal(t, "apm-aws-lambda/1.2.0 (nodejs18.x)", r.UserAgent())
+		// The headers of the extension take precedence.
+		assert.Equal(t, []string{"ApiKey key"}, r.Header.Values("Authorization"))
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAPIKey("key"),
+		apmproxy.WithHeaders(map[string]string{
+			"X-Tenant":      "tenant-a",
+			"Authorization": "Basic gateway",
+			"Content-Type":  "text/plain",
+		}),
+		apmproxy.WithFunctionRuntime("nodejs18.x"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte(`{"metadata":{}}`)}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
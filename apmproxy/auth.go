@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	authMissingMessage = "authentication failed: missing or improperly formatted Authorization header"
+	authInvalidMessage = "authentication failed: invalid credentials"
+)
+
+// receiverAuth holds the credentials that agents must present to the
+// receiver. A request is authorized if it matches either of them.
+type receiverAuth struct {
+	secretToken string
+	apiKey      string
+}
+
+// withReceiverAuth wraps the handler to reject requests whose credentials
+// don't match the ones configured for the receiver, if any.
+func (c *Client) withReceiverAuth(h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if c.receiverAuth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if msg, ok := c.receiverAuth.authorize(r.Header.Get("Authorization")); !ok {
+			c.logger.Warnf("Rejecting unauthorized agent request to %s: %s", r.URL.Path, msg)
+			c.writeIntakeError(w, http.StatusUnauthorized, msg)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// authorize checks the value of an Authorization header, returning the
+// reason if the request is not authorized.
+func (a *receiverAuth) authorize(header string) (string, bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || credentials == "" {
+		return authMissingMessage, false
+	}
+
+	var expected string
+	switch scheme {
+	case "Bearer":
+		expected = a.secretToken
+	case "ApiKey":
+		expected = a.apiKey
+	default:
+		return authMissingMessage, false
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(credentials), []byte(expected)) != 1 {
+		return authInvalidMessage, false
+	}
+	return "", true
+}
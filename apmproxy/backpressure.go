@@ -0,0 +1,157 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+)
+
+// BackpressurePolicy represents how the receiver handles agent data
+// when the agent data channel is full.
+type BackpressurePolicy string
+
+const (
+	// DropNewest drops the agent data that was just received.
+	DropNewest BackpressurePolicy = "drop_newest"
+
+	// DropOldest drops the oldest agent data waiting in the channel to
+	// make room for the agent data that was just received.
+	DropOldest BackpressurePolicy = "drop_oldest"
+
+	// Block waits for room in the channel, up to the backpressure
+	// timeout, before dropping the agent data that was just received.
+	Block BackpressurePolicy = "block"
+
+	// Reject responds to the agent with a 503 status code and a
+	// Retry-After header, leaving the retry and buffering to the agent.
+	Reject BackpressurePolicy = "reject"
+
+	defaultBackpressureTimeout time.Duration = 500 * time.Millisecond
+	defaultRetryAfterSeconds                 = "1"
+)
+
+// Reasons for the receiver dropping agent events.
+const (
+	DroppedChannelFull   = "channel_full"
+	DroppedEvicted       = "evicted"
+	DroppedBlockTimeout  = "block_timeout"
+	DroppedEventTooLarge = "event_too_large"
+)
+
+// DroppedEvents returns the number of agent events dropped by the
+// receiver since the client was created, keyed by reason.
+func (c *Client) DroppedEvents() map[string]int {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	dropped := make(map[string]int, len(c.droppedEvents))
+	for reason, n := range c.droppedEvents {
+		dropped[reason] = n
+	}
+	return dropped
+}
+
+// RejectedEvents returns the number of agent events rejected by the
+// receiver with a 503 status code since the client was created. The
+// rejected events are left for the agent to retry, they are not dropped.
+func (c *Client) RejectedEvents() int {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.rejectedEvents
+}
+
+func (c *Client) recordRejected(n int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.rejectedEvents += n
+	c.telemetry.eventsRejected += n
+}
+
+func (c *Client) recordDropped(reason string, n int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.droppedEvents == nil {
+		c.droppedEvents = make(map[string]int)
+	}
+	c.droppedEvents[reason] += n
+	if c.telemetry.dropped == nil {
+		c.telemetry.dropped = make(map[string]int)
+	}
+	c.telemetry.dropped[reason] += n
+}
+
+// enqueueAgentData sends the agent data to the agent data channel
+// applying the backpressure policy if the channel is full. It returns
+// false if the data is rejected and the agent should retry.
+func (c *Client) enqueueAgentData(ctx context.Context, agentData accumulator.APMData) bool {
+	c.recordReceived(countEvents(agentData))
+
+	select {
+	case c.AgentDataChannel <- agentData:
+		return true
+	default:
+	}
+
+	switch c.backpressurePolicy {
+	case DropOldest:
+		select {
+		case oldest := <-c.AgentDataChannel:
+			c.logger.Warn("Channel full: dropping the oldest agent data")
+			c.recordDropped(DroppedEvicted, countEvents(oldest))
+		default:
+		}
+		// Another request might have taken the room in the meantime.
+		select {
+		case c.AgentDataChannel <- agentData:
+			return true
+		default:
+		}
+		c.logger.Warnf("Channel full: dropping a subset of agent data")
+		c.recordDropped(DroppedChannelFull, countEvents(agentData))
+		return true
+	case Block:
+		timer := time.NewTimer(c.backpressureTimeout)
+		defer timer.Stop()
+		select {
+		case c.AgentDataChannel <- agentData:
+			return true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		c.logger.Warnf("Channel full for %s: dropping a subset of agent data", c.backpressureTimeout)
+		c.recordDropped(DroppedBlockTimeout, countEvents(agentData))
+		return true
+	case Reject:
+		c.logger.Warn("Channel full: rejecting agent data")
+		c.recordRejected(countEvents(agentData))
+		return false
+	default:
+		c.logger.Warnf("Channel full: dropping a subset of agent data")
+		c.recordDropped(DroppedChannelFull, countEvents(agentData))
+		return true
+	}
+}
+
+// countEvents returns the number of events, excluding the metadata, in
+// uncompressed agent data.
+func countEvents(agentData accumulator.APMData) int {
+	return bytes.Count(bytes.TrimSpace(agentData.Data), newLineSep)
+}
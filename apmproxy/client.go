@@ -20,6 +20,7 @@ package apmproxy
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -48,6 +49,7 @@ const (
 	defaultReceiverAddr                       = ":8200"
 	defaultAgentBufferSize      int           = 100
 	defaultLambdaBufferSize     int           = 100
+	defaultSpillDir                           = "/tmp/elastic-apm-lambda-spill"
 )
 
 // Client is the client used to communicate with the apm server.
@@ -57,19 +59,82 @@ type Client struct {
 	AgentDataChannel  chan accumulator.APMData
 	LambdaDataChannel chan []byte
 	client            *http.Client
-	Status            Status
-	ReconnectionCount int
 	ServerAPIKey      string
 	ServerSecretToken string
-	serverURL         string
+	serverURLs        []string
 	receiver          *http.Server
 	sendStrategy      SendStrategy
 	logger            *zap.SugaredLogger
 
+	// receiverMaxBodySize and receiverMaxEventSize limit the size, in
+	// bytes, of the uncompressed agent intake requests and events.
+	receiverMaxBodySize  int64
+	receiverMaxEventSize int
+	receiverAuth         *receiverAuth
+	receiverLoopbackOnly bool
+	receiverSocket       string
+
+	backpressurePolicy  BackpressurePolicy
+	backpressureTimeout time.Duration
+
+	// endpoint is the currently active APM Server endpoint. Its transport
+	// state is promoted as the Status and ReconnectionCount of the client.
+	*endpoint
+	endpoints    []*endpoint
+	endpointMode EndpointMode
+	// done is closed on shutdown to stop the grace period goroutines
+	// tracked by gracePeriods.
+	done         chan struct{}
+	shutdownOnce sync.Once
+	gracePeriods sync.WaitGroup
+
 	flushMutex sync.Mutex
 	flushCh    chan struct{}
 
 	batch *accumulator.Batch
+
+	retryMaxAttempts int
+	retryBackoff     time.Duration
+	retryMaxBackoff  time.Duration
+
+	streaming     bool
+	streamMaxSize int
+	streamMaxAge  time.Duration
+	streamMu      sync.Mutex
+	stream        *intakeStream
+
+	spillDir     string
+	spillMaxSize int64
+	spill        *spillQueue
+
+	logsAPIState func() string
+
+	// selfTelemetry enables reporting the telemetry of the extension,
+	// including the drops of the Logs API returned by logsAPIDropped.
+	selfTelemetry  bool
+	logsAPIDropped func() (records, bytes int64)
+
+	// headers are set on the requests to the APM Server along with the
+	// userAgent of the extension.
+	headers   map[string]string
+	userAgent string
+
+	otlpOutput *otlpOutput
+
+	// tls configures the transport shared by the data sender and the info
+	// proxy.
+	tls *tlsOptions
+
+	infoCacheTTL time.Duration
+	infoPrefetch bool
+	infoCache    *infoCache
+
+	statsMu        sync.Mutex
+	intakeStats    IntakeStats
+	reportedStats  IntakeStats
+	droppedEvents  map[string]int
+	rejectedEvents int
+	telemetry      telemetry
 }
 
 func NewClient(opts ...Option) (*Client, error) {
@@ -82,16 +147,28 @@ func NewClient(opts ...Option) (*Client, error) {
 		client: &http.Client{
 			Transport: http.DefaultTransport.(*http.Transport).Clone(),
 		},
-		ReconnectionCount: -1,
-		Status:            Started,
 		receiver: &http.Server{
 			Addr:           defaultReceiverAddr,
 			ReadTimeout:    defaultDataReceiverTimeout,
 			WriteTimeout:   defaultDataReceiverTimeout,
 			MaxHeaderBytes: 1 << 20,
 		},
-		sendStrategy: SyncFlush,
-		flushCh:      make(chan struct{}),
+		endpointMode:     Failover,
+		done:             make(chan struct{}),
+		sendStrategy:     SyncFlush,
+		flushCh:          make(chan struct{}),
+		retryMaxAttempts: defaultRetryMaxAttempts,
+		retryBackoff:     defaultRetryBackoff,
+		retryMaxBackoff:  defaultRetryMaxBackoff,
+		streamMaxSize:    defaultStreamMaxSize,
+		streamMaxAge:     defaultStreamMaxAge,
+		userAgent:        userAgent(""),
+
+		receiverMaxBodySize:  defaultReceiverMaxBodySize,
+		receiverMaxEventSize: defaultReceiverMaxEventSize,
+
+		backpressurePolicy:  DropNewest,
+		backpressureTimeout: defaultBackpressureTimeout,
 	}
 
 	c.client.Timeout = defaultDataForwarderTimeout
@@ -100,17 +177,89 @@ func NewClient(opts ...Option) (*Client, error) {
 		opt(&c)
 	}
 
-	if c.serverURL == "" {
+	if len(c.serverURLs) == 0 {
 		return nil, errors.New("APM Server URL cannot be empty")
 	}
 
+	for _, serverURL := range c.serverURLs {
+		if serverURL == "" {
+			return nil, errors.New("APM Server URL cannot be empty")
+		}
+		// normalize server URL
+		if !strings.HasSuffix(serverURL, "/") {
+			serverURL = serverURL + "/"
+		}
+		c.endpoints = append(c.endpoints, newEndpoint(serverURL))
+	}
+	c.endpoint = c.endpoints[0]
+
+	if c.endpointMode != Failover && c.endpointMode != Fanout {
+		return nil, fmt.Errorf("invalid endpoint mode: %s", c.endpointMode)
+	}
+
 	if c.logger == nil {
 		return nil, errors.New("logger cannot be empty")
 	}
 
-	// normalize server URL
-	if !strings.HasSuffix(c.serverURL, "/") {
-		c.serverURL = c.serverURL + "/"
+	switch c.backpressurePolicy {
+	case DropNewest, DropOldest, Block, Reject:
+	default:
+		return nil, fmt.Errorf("invalid backpressure policy: %s", c.backpressurePolicy)
+	}
+
+	if c.otlpOutput != nil {
+		switch c.otlpOutput.compression {
+		case OTLPCompressionGzip, OTLPCompressionNone:
+		default:
+			return nil, fmt.Errorf("invalid OTLP compression: %s", c.otlpOutput.compression)
+		}
+		if c.streaming {
+			return nil, errors.New("streaming intake requests is not supported with the OTLP output")
+		}
+	}
+
+	// The intake stream is opened to the active endpoint only.
+	if c.streaming && c.endpointMode == Fanout && len(c.endpoints) > 1 {
+		return nil, errors.New("streaming intake requests is not supported in fanout mode")
+	}
+
+	if c.receiverAuth != nil && c.receiverAuth.secretToken == "" && c.receiverAuth.apiKey == "" {
+		return nil, errors.New("receiver authentication requires a secret token or an API key")
+	}
+
+	if c.receiverMaxBodySize <= 0 || c.receiverMaxEventSize <= 0 {
+		return nil, errors.New("receiver max body and event size must be positive")
+	}
+
+	if c.tls != nil {
+		cfg, err := c.tls.config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings: %w", err)
+		}
+		c.client.Transport.(*http.Transport).TLSClientConfig = cfg
+	}
+
+	if c.infoPrefetch && c.infoCacheTTL == 0 {
+		c.infoCacheTTL = defaultInfoCacheTTL
+	}
+	if c.infoCacheTTL > 0 {
+		c.infoCache = &infoCache{ttl: c.infoCacheTTL}
+	}
+
+	if c.spillMaxSize > 0 {
+		// A batch spilled for one endpoint would be replayed to all of
+		// them, duplicating the data of the endpoints that accepted it.
+		if c.endpointMode == Fanout && len(c.endpoints) > 1 {
+			return nil, errors.New("spill queue is not supported in fanout mode")
+		}
+		if c.spillDir == "" {
+			c.spillDir = defaultSpillDir
+		}
+		spill, err := newSpillQueue(c.spillDir, c.spillMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		c.spill = spill
 	}
 
 	rand.Seed(time.Now().UnixNano())
@@ -44,6 +44,24 @@ func TestClient(t *testing.T) {
 			},
 			expectedErr: true,
 		},
+		"spill queue with fanout": {
+			opts: []apmproxy.Option{
+				apmproxy.WithURLs("https://primary.example.com", "https://secondary.example.com"),
+				apmproxy.WithEndpointMode(apmproxy.Fanout),
+				apmproxy.WithSpillQueue(t.TempDir(), 1024),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			},
+			expectedErr: true,
+		},
+		"intake stream with fanout": {
+			opts: []apmproxy.Option{
+				apmproxy.WithURLs("https://primary.example.com", "https://secondary.example.com"),
+				apmproxy.WithEndpointMode(apmproxy.Fanout),
+				apmproxy.WithIntakeStream(0, 0),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			},
+			expectedErr: true,
+		},
 		"valid": {
 			opts: []apmproxy.Option{
 				apmproxy.WithURL("https://example.com"),
@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import "time"
+
+// EndpointMode represents how data is distributed when multiple APM
+// Server endpoints are configured.
+type EndpointMode string
+
+const (
+	// Failover mode sends data to the first endpoint, in the configured
+	// order, whose transport is not failing.
+	Failover EndpointMode = "failover"
+
+	// Fanout mode sends every batch to all endpoints whose transport
+	// is not failing.
+	Fanout EndpointMode = "fanout"
+)
+
+// endpoint holds the URL of an APM Server together with the state of
+// the transport to it. Every endpoint backs off independently.
+type endpoint struct {
+	serverURL         string
+	Status            Status
+	ReconnectionCount int
+	// gracePeriodEnd is the time at which the transport leaves the
+	// failing status.
+	gracePeriodEnd time.Time
+}
+
+func newEndpoint(serverURL string) *endpoint {
+	return &endpoint{
+		serverURL:         serverURL,
+		Status:            Started,
+		ReconnectionCount: -1,
+	}
+}
+
+// activeEndpoint returns the first endpoint whose transport is not failing
+// and marks it as the active one. If all the endpoints are failing the
+// currently active endpoint is returned along with false.
+func (c *Client) activeEndpoint() (*endpoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.endpoints {
+		if e.Status == Failing {
+			continue
+		}
+		if e != c.endpoint {
+			c.logger.Infof("Switching active APM server to %s", e.serverURL)
+			c.endpoint = e
+		}
+		return e, true
+	}
+	return c.endpoint, false
+}
+
+func (c *Client) isFailing(e *endpoint) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return e.Status == Failing
+}
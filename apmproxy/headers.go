@@ -0,0 +1,55 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// userAgent returns the User-Agent of the requests sent by the extension,
+// along with the runtime of the function if it's known.
+func userAgent(runtime string) string {
+	ua := "apm-aws-lambda/" + extension.Version
+	if runtime != "" {
+		ua += " (" + runtime + ")"
+	}
+	return ua
+}
+
+// setCustomHeaders sets the configured headers and the User-Agent of the
+// extension on requests to the APM Server. They are set before the
+// Content-* and Authorization headers, which take precedence.
+func (c *Client) setCustomHeaders(req *http.Request) {
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+}
+
+// setProxyHeaders sets the configured headers on requests proxied to the
+// APM Server on behalf of the agents. The User-Agent of the extension is
+// appended to the one of the agent.
+func (c *Client) setProxyHeaders(req *http.Request) {
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", strings.TrimSpace(req.UserAgent()+" "+c.userAgent))
+}
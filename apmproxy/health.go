@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+const logsAPIDisabled = "disabled"
+
+// ExtensionStatus is the state of the extension as reported by the
+// status endpoint of the receiver.
+type ExtensionStatus struct {
+	Status            Status `json:"status"`
+	ReconnectionCount int    `json:"reconnection_count"`
+	// GracePeriodRemainingMs is the time left, in milliseconds, before
+	// the transport leaves the failing status.
+	GracePeriodRemainingMs int64            `json:"grace_period_remaining_ms"`
+	Endpoints              []EndpointStatus `json:"endpoints"`
+	AgentData              ChannelStatus    `json:"agent_data_channel"`
+	LambdaData             ChannelStatus    `json:"lambda_data_channel"`
+	Batch                  BatchStatus      `json:"batch"`
+	LogsAPI                string           `json:"logs_api"`
+}
+
+// EndpointStatus is the state of the transport to an APM Server.
+type EndpointStatus struct {
+	URL                    string `json:"url"`
+	Status                 Status `json:"status"`
+	ReconnectionCount      int    `json:"reconnection_count"`
+	GracePeriodRemainingMs int64  `json:"grace_period_remaining_ms"`
+	Active                 bool   `json:"active"`
+}
+
+// ChannelStatus is the fill level of a data channel.
+type ChannelStatus struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// BatchStatus is the state of the batch waiting to be shipped.
+type BatchStatus struct {
+	Count              int   `json:"count"`
+	AgeMs              int64 `json:"age_ms"`
+	PendingInvocations int   `json:"pending_invocations"`
+}
+
+// ExtensionStatus returns the current state of the extension.
+func (c *Client) ExtensionStatus() ExtensionStatus {
+	status := ExtensionStatus{
+		AgentData:  ChannelStatus{Len: len(c.AgentDataChannel), Cap: cap(c.AgentDataChannel)},
+		LambdaData: ChannelStatus{Len: len(c.LambdaDataChannel), Cap: cap(c.LambdaDataChannel)},
+		LogsAPI:    logsAPIDisabled,
+	}
+
+	c.mu.RLock()
+	now := time.Now()
+	for _, e := range c.endpoints {
+		es := EndpointStatus{
+			URL:               e.serverURL,
+			Status:            e.Status,
+			ReconnectionCount: e.ReconnectionCount,
+			Active:            e == c.endpoint,
+		}
+		if e.Status == Failing && e.gracePeriodEnd.After(now) {
+			es.GracePeriodRemainingMs = e.gracePeriodEnd.Sub(now).Milliseconds()
+		}
+		if es.Active {
+			status.Status = es.Status
+			status.ReconnectionCount = es.ReconnectionCount
+			status.GracePeriodRemainingMs = es.GracePeriodRemainingMs
+		}
+		status.Endpoints = append(status.Endpoints, es)
+	}
+	c.mu.RUnlock()
+
+	if c.batch != nil {
+		status.Batch = BatchStatus{
+			Count:              c.batch.Count(),
+			AgeMs:              c.batch.Age().Milliseconds(),
+			PendingInvocations: c.batch.PendingInvocations(),
+		}
+	}
+	if c.logsAPIState != nil {
+		status.LogsAPI = c.logsAPIState()
+	}
+	return status
+}
+
+// URL: http://server/extension/status
+func (c *Client) handleStatusRequest() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// The status is only meant for processes running alongside the
+		// extension.
+		if !isLoopback(r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.ExtensionStatus()); err != nil {
+			c.logger.Warnf("Failed to write extension status: %v", err)
+		}
+	}
+}
+
+func isLoopback(remoteAddr string) bool {
+	// Requests received on the Unix domain socket have no remote address.
+	if remoteAddr == "" || remoteAddr == "@" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,162 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultInfoCacheTTL is the TTL of the info cache if it is only enabled
+// by WithInfoPrefetch.
+const defaultInfoCacheTTL time.Duration = 5 * time.Minute
+
+// infoCache holds the last successful responses of the APM Servers to info
+// requests. The responses are only served while they are fresh, to the
+// requests for the same endpoint with the same credentials.
+type infoCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[infoCacheKey]infoCacheEntry
+}
+
+// infoCacheKey identifies the endpoint and the Authorization header a
+// response was fetched with.
+type infoCacheKey struct {
+	endpoint *endpoint
+	auth     string
+}
+
+type infoCacheEntry struct {
+	header  http.Header
+	body    []byte
+	fetched time.Time
+}
+
+func (ic *infoCache) store(key infoCacheKey, header http.Header, body []byte) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.entries == nil {
+		ic.entries = make(map[infoCacheKey]infoCacheEntry)
+	}
+	ic.entries[key] = infoCacheEntry{header: header.Clone(), body: body, fetched: time.Now()}
+}
+
+func (ic *infoCache) load(key infoCacheKey) (http.Header, []byte, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	entry, ok := ic.entries[key]
+	if !ok || time.Since(entry.fetched) > ic.ttl {
+		return nil, nil, false
+	}
+	return entry.header, entry.body, true
+}
+
+// PrefetchInfo fetches the APM Server info with the credentials of the
+// extension and caches it, so that agents presenting the same credentials
+// don't wait for a round trip to the APM Server. It does nothing unless
+// enabled with WithInfoPrefetch.
+func (c *Client) PrefetchInfo(ctx context.Context) error {
+	if !c.infoPrefetch || c.infoCache == nil || c.otlpOutput != nil {
+		return nil
+	}
+
+	e, _ := c.activeEndpoint()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.serverURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create info request: %w", err)
+	}
+	c.setCustomHeaders(req)
+	c.setAuthHeader(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch APM server info: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch APM server info: response status code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read APM server info: %w", err)
+	}
+	c.infoCache.store(infoCacheKey{endpoint: e, auth: req.Header.Get("Authorization")}, resp.Header, body)
+	c.logger.Debug("Prefetched APM server info")
+	return nil
+}
+
+// cacheInfoResponse caches the successful responses of the endpoint to
+// info requests. It returns an error for server errors if a cached response
+// can be served instead.
+func (c *Client) cacheInfoResponse(e *endpoint, resp *http.Response) error {
+	if c.infoCache == nil || !isInfoRequest(resp.Request) {
+		return nil
+	}
+	key := infoCacheKey{endpoint: e, auth: resp.Request.Header.Get("Authorization")}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.infoCache.store(key, resp.Header, body)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		if _, _, ok := c.infoCache.load(key); ok {
+			return fmt.Errorf("response status code: %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// serveCachedInfo writes the cached info response of the endpoint for the
+// credentials of the request, if any is fresh, and returns whether it did.
+func (c *Client) serveCachedInfo(e *endpoint, w http.ResponseWriter, r *http.Request) bool {
+	if c.infoCache == nil || !isInfoRequest(r) {
+		return false
+	}
+	header, body, ok := c.infoCache.load(infoCacheKey{endpoint: e, auth: r.Header.Get("Authorization")})
+	if !ok {
+		return false
+	}
+	for k, v := range header {
+		switch k {
+		case "Content-Length", "Date", "Connection", "Transfer-Encoding":
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		c.logger.Errorf("Failed to send cached info response to APM agent : %v", err)
+	}
+	return true
+}
+
+func isInfoRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/" || r.URL.Path == "")
+}
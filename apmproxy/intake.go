@@ -0,0 +1,168 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/logsapi"
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// Reasons for APM Server rejecting events.
+const (
+	RejectedUnauthorized = "unauthorized"
+	RejectedRateLimited  = "rate_limited"
+	RejectedQueueFull    = "queue_full"
+	RejectedTooLarge     = "too_large"
+	RejectedValidation   = "validation"
+	RejectedServerError  = "server_error"
+	RejectedOther        = "other"
+)
+
+// IntakeStats holds the number of events accepted and rejected by
+// APM Server, as reported in the intake responses.
+type IntakeStats struct {
+	Accepted int
+	// Rejected holds the number of rejected events keyed by reason.
+	Rejected map[string]int
+}
+
+// IntakeStats returns the number of events accepted and rejected by
+// APM Server since the client was created.
+func (c *Client) IntakeStats() IntakeStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.intakeStats.clone()
+}
+
+func (s IntakeStats) clone() IntakeStats {
+	rejected := make(map[string]int, len(s.Rejected))
+	for reason, n := range s.Rejected {
+		rejected[reason] = n
+	}
+	return IntakeStats{Accepted: s.Accepted, Rejected: rejected}
+}
+
+// recordIntakeResult updates the intake stats and logs the rejected
+// events, if any, prefixing each log line with kind.
+func (c *Client) recordIntakeResult(statusCode int, result jsonResult, kind string) {
+	c.statsMu.Lock()
+	c.intakeStats.Accepted += result.Accepted
+	for _, err := range result.Errors {
+		if c.intakeStats.Rejected == nil {
+			c.intakeStats.Rejected = make(map[string]int)
+		}
+		c.intakeStats.Rejected[rejectionReason(statusCode, err.Message)]++
+	}
+	c.statsMu.Unlock()
+
+	for _, err := range result.Errors {
+		if err.Document == "" {
+			c.logger.Warnf("%s: message: %s", kind, err.Message)
+			continue
+		}
+		c.logger.Warnf("%s: %s event rejected: document %s: message: %s", kind, eventType(err.Document), err.Document, err.Message)
+	}
+}
+
+// addIntakeMetrics adds a metricset with the intake stats accumulated
+// since the last report to the batch. Nothing is added if no event was
+// accepted or rejected in the meantime.
+func (c *Client) addIntakeMetrics() {
+	if c.batch == nil {
+		return
+	}
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	changed := c.intakeStats.Accepted != c.reportedStats.Accepted
+	for reason, n := range c.intakeStats.Rejected {
+		changed = changed || n != c.reportedStats.Rejected[reason]
+	}
+	if !changed {
+		return
+	}
+
+	mc := logsapi.MetricsContainer{
+		Metrics: &model.Metrics{Timestamp: model.Time(time.Now())},
+	}
+	mc.Add("extension.intake.events.accepted", float64(c.intakeStats.Accepted-c.reportedStats.Accepted))
+	for reason, n := range c.intakeStats.Rejected {
+		if rejected := n - c.reportedStats.Rejected[reason]; rejected > 0 {
+			mc.Add("extension.intake.events.rejected."+reason, float64(rejected))
+		}
+	}
+
+	var w fastjson.Writer
+	if err := mc.MarshalFastJSON(&w); err != nil {
+		c.logger.Warnf("Failed to marshal intake metrics: %v", err)
+		return
+	}
+	if err := c.batch.AddLambdaData(w.Bytes()); err != nil {
+		c.logger.Debugf("Failed to add intake metrics to batch: %v", err)
+		return
+	}
+	c.reportedStats = c.intakeStats.clone()
+}
+
+// rejectionReason maps the status code and error message of an intake
+// response to a rejection reason.
+func rejectionReason(statusCode int, message string) string {
+	msg := strings.ToLower(message)
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return RejectedUnauthorized
+	case statusCode == http.StatusTooManyRequests:
+		return RejectedRateLimited
+	case strings.Contains(msg, "queue is full"):
+		return RejectedQueueFull
+	case strings.Contains(msg, "exceeded the permitted size"),
+		strings.Contains(msg, "too large"):
+		return RejectedTooLarge
+	case strings.Contains(msg, "validation error"),
+		strings.Contains(msg, "decode error"),
+		strings.Contains(msg, "invalid"):
+		return RejectedValidation
+	case statusCode >= http.StatusInternalServerError:
+		return RejectedServerError
+	}
+	return RejectedOther
+}
+
+// eventType returns the type of an intake v2 event, i.e. its top level
+// key, or "unknown" if the document is not a valid event.
+func eventType(document string) string {
+	dec := json.NewDecoder(strings.NewReader(document))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "unknown"
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return "unknown"
+	}
+	if key, ok := tok.(string); ok {
+		return key
+	}
+	return "unknown"
+}
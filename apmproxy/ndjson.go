@@ -0,0 +1,162 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+)
+
+const (
+	defaultReceiverMaxBodySize  int64 = 10 * 1024 * 1024
+	defaultReceiverMaxEventSize int   = 300 * 1024
+)
+
+var (
+	// errBodyTooLarge is returned when the uncompressed body of an intake
+	// request exceeds the maximum body size of the receiver.
+	errBodyTooLarge = errors.New("request body exceeded the permitted size")
+	// errMetadataTooLarge is returned when the metadata of an intake
+	// request exceeds the maximum event size of the receiver.
+	errMetadataTooLarge = errors.New("metadata exceeded the permitted size")
+)
+
+// readIntakeBody reads the, possibly compressed, ndjson body of an intake
+// request line by line. Events larger than the maximum event size are
+// dropped on their own and the number of dropped events is returned. The
+// returned data is uncompressed.
+func (c *Client) readIntakeBody(r *http.Request) (accumulator.APMData, int, error) {
+	body, err := decodeBody(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		return accumulator.APMData{}, 0, err
+	}
+
+	// Read one more byte than permitted to detect bodies that are too large.
+	lr := &io.LimitedReader{R: body, N: c.receiverMaxBodySize + 1}
+	br := bufio.NewReader(lr)
+
+	var (
+		buf         bytes.Buffer
+		dropped     int
+		hasMetadata bool
+	)
+	for {
+		tooLarge, err := readEvent(br, &buf, c.receiverMaxEventSize)
+		if lr.N <= 0 {
+			return accumulator.APMData{}, 0, errBodyTooLarge
+		}
+		if tooLarge {
+			// The first line of the body is the metadata which is
+			// required by all the other events.
+			if !hasMetadata {
+				return accumulator.APMData{}, 0, errMetadataTooLarge
+			}
+			dropped++
+		} else if buf.Len() > 0 {
+			hasMetadata = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return accumulator.APMData{}, 0, err
+		}
+	}
+	return accumulator.APMData{Data: bytes.TrimSuffix(buf.Bytes(), newLineSep)}, dropped, nil
+}
+
+// readEvent reads a single line from br and appends it to buf, along
+// with the newline separator. Empty lines are skipped. A line larger than
+// maxSize is discarded without being buffered entirely and true is
+// returned.
+func readEvent(br *bufio.Reader, buf *bytes.Buffer, maxSize int) (bool, error) {
+	start := buf.Len()
+	tooLarge := false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLarge {
+			buf.Write(chunk)
+			// Account for the newline separator and carriage return.
+			if buf.Len()-start > maxSize+2 {
+				tooLarge = true
+				buf.Truncate(start)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if !tooLarge {
+			event := bytes.TrimRight(buf.Bytes()[start:], "\r\n")
+			switch {
+			case len(event) == 0:
+				buf.Truncate(start)
+			case len(event) > maxSize:
+				tooLarge = true
+				buf.Truncate(start)
+			default:
+				buf.Truncate(start + len(event))
+				buf.Write(newLineSep)
+			}
+		}
+		return tooLarge, err
+	}
+}
+
+// decodeBody returns a reader for the uncompressed content of body.
+func decodeBody(body io.Reader, encoding string) (io.Reader, error) {
+	var (
+		r   io.Reader
+		err error
+	)
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	default:
+		return body, nil
+	}
+	if errors.Is(err, io.EOF) {
+		// Empty body.
+		return bytes.NewReader(nil), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %w", encoding, err)
+	}
+	return r, nil
+}
+
+// writeIntakeError writes an error response in the format used by the
+// intake endpoint of APM Server.
+func (c *Client) writeIntakeError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(jsonResult{Errors: []jsonError{{Message: message}}}); err != nil {
+		c.logger.Errorf("Failed to send intake response to APM agent : %v", err)
+	}
+}
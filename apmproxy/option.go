@@ -40,7 +40,23 @@ func WithSecretToken(secret string) Option {
 
 func WithURL(url string) Option {
 	return func(c *Client) {
-		c.serverURL = url
+		c.serverURLs = []string{url}
+	}
+}
+
+// WithURLs sets multiple APM Server endpoints. How the data is
+// distributed among them is controlled by WithEndpointMode.
+func WithURLs(urls ...string) Option {
+	return func(c *Client) {
+		c.serverURLs = urls
+	}
+}
+
+// WithEndpointMode sets how data is sent when multiple APM Server
+// endpoints are configured. Defaults to Failover.
+func WithEndpointMode(mode EndpointMode) Option {
+	return func(c *Client) {
+		c.endpointMode = mode
 	}
 }
 
@@ -65,6 +81,86 @@ func WithReceiverAddress(addr string) Option {
 	}
 }
 
+// WithReceiverSocket makes the receiver listen on a Unix domain socket at
+// the given path, alongside the TCP listener.
+func WithReceiverSocket(path string) Option {
+	return func(c *Client) {
+		c.receiverSocket = path
+	}
+}
+
+// WithReceiverAuth requires agents to authenticate to the receiver with
+// either the secret token or the API key, for the intake, transaction
+// registration and OTLP requests. The info requests proxied to the APM
+// server, on the root path, are authenticated too, as they would be by the
+// APM server. Empty credentials are never accepted.
+func WithReceiverAuth(secretToken, apiKey string) Option {
+	return func(c *Client) {
+		c.receiverAuth = &receiverAuth{secretToken: secretToken, apiKey: apiKey}
+	}
+}
+
+// WithReceiverLoopbackOnly binds the receiver to the loopback interface
+// only, ignoring the host of the receiver address.
+func WithReceiverLoopbackOnly(loopbackOnly bool) Option {
+	return func(c *Client) {
+		c.receiverLoopbackOnly = loopbackOnly
+	}
+}
+
+// WithReceiverMaxBodySize sets the maximum size, in bytes, of the
+// uncompressed body of agent intake requests. Larger requests are
+// rejected with a 413 status code.
+func WithReceiverMaxBodySize(size int64) Option {
+	return func(c *Client) {
+		c.receiverMaxBodySize = size
+	}
+}
+
+// WithReceiverMaxEventSize sets the maximum size, in bytes, of a single
+// event in agent intake requests. Larger events are dropped.
+func WithReceiverMaxEventSize(size int) Option {
+	return func(c *Client) {
+		c.receiverMaxEventSize = size
+	}
+}
+
+// WithBackpressurePolicy sets how the receiver handles agent data when
+// the agent data channel is full. Defaults to DropNewest.
+func WithBackpressurePolicy(policy BackpressurePolicy) Option {
+	return func(c *Client) {
+		c.backpressurePolicy = policy
+	}
+}
+
+// WithBackpressureTimeout sets how long the receiver waits for room in
+// the agent data channel with the Block policy.
+func WithBackpressureTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.backpressureTimeout = timeout
+	}
+}
+
+// WithInfoCacheTTL sets for how long the last successful APM Server info
+// response is served to agents when the APM Server is unreachable. The
+// cache is disabled by default, or with a zero TTL, unless info prefetch
+// is enabled.
+func WithInfoCacheTTL(ttl time.Duration) Option {
+	return func(c *Client) {
+		c.infoCacheTTL = ttl
+	}
+}
+
+// WithInfoPrefetch enables fetching the APM Server info ahead of agent
+// requests with PrefetchInfo. The cached info is then served directly to
+// the agents presenting the credentials of the extension while it is
+// fresh. It enables the info cache, for 5 minutes if no TTL is set.
+func WithInfoPrefetch(prefetch bool) Option {
+	return func(c *Client) {
+		c.infoPrefetch = prefetch
+	}
+}
+
 // WithSendStrategy sets the sendstrategy.
 func WithSendStrategy(strategy SendStrategy) Option {
 	return func(c *Client) {
@@ -94,3 +190,148 @@ func WithBatch(batch *accumulator.Batch) Option {
 		c.batch = batch
 	}
 }
+
+// WithRetryMaxAttempts sets the maximum number of attempts for sending
+// a request to the APM Server. Only transient failures are retried.
+// A value of 1 disables retries.
+func WithRetryMaxAttempts(attempts int) Option {
+	return func(c *Client) {
+		c.retryMaxAttempts = attempts
+	}
+}
+
+// WithRetryBackoff sets the base delay between two attempts. The delay
+// grows exponentially with each attempt and is jittered.
+func WithRetryBackoff(backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retryBackoff = backoff
+	}
+}
+
+// WithRetryMaxBackoff sets the maximum delay between two attempts. A
+// Retry-After header sent by the APM Server is honored up to this delay.
+func WithRetryMaxBackoff(backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retryMaxBackoff = backoff
+	}
+}
+
+// WithIntakeStream enables streaming of events to the APM Server over a
+// long-lived request. The request is completed when a flush is requested
+// or when it reaches maxSize bytes or maxAge, whichever comes first. Zero
+// values keep the defaults. Events already written to a stream that
+// fails to complete are not spilled.
+func WithIntakeStream(maxSize int, maxAge time.Duration) Option {
+	return func(c *Client) {
+		c.streaming = true
+		if maxSize > 0 {
+			c.streamMaxSize = maxSize
+		}
+		if maxAge > 0 {
+			c.streamMaxAge = maxAge
+		}
+	}
+}
+
+// WithSpillQueue enables persisting batches that could not be delivered
+// to the APM Server to dir, up to maxSize bytes. Spilled batches are
+// replayed once the transport recovers. An empty dir defaults to a
+// directory under /tmp. The spill queue tracks the delivery to a single
+// endpoint at a time, it is not supported in fanout mode.
+func WithSpillQueue(dir string, maxSize int64) Option {
+	return func(c *Client) {
+		c.spillDir = dir
+		c.spillMaxSize = maxSize
+	}
+}
+
+// WithLogsAPIState sets the function reporting the state of the Logs API
+// subscription in the extension status. The Logs API is reported as
+// disabled if not set.
+func WithLogsAPIState(f func() string) Option {
+	return func(c *Client) {
+		c.logsAPIState = f
+	}
+}
+
+// WithOTLPOutput sends the data to the configured URLs as OTLP/HTTP
+// protobuf, instead of the intake v2 API of APM Server. The headers are
+// added to every export request and compression is either gzip, the
+// default, or none.
+func WithOTLPOutput(headers map[string]string, compression string) Option {
+	return func(c *Client) {
+		if compression == "" {
+			compression = OTLPCompressionGzip
+		}
+		c.otlpOutput = &otlpOutput{headers: headers, compression: compression}
+	}
+}
+
+// WithHeaders sets headers added to the data and info requests sent to
+// the APM Server. They don't override the Content-* and Authorization
+// headers set by the extension.
+func WithHeaders(headers map[string]string) Option {
+	return func(c *Client) {
+		c.headers = headers
+	}
+}
+
+// WithFunctionRuntime sets the runtime of the function reported in the
+// User-Agent of the requests sent by the extension.
+func WithFunctionRuntime(runtime string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent(runtime)
+	}
+}
+
+// WithServerCACert trusts the certificates of the PEM encoded CA bundle,
+// in addition to the system roots, when verifying the APM Server.
+func WithServerCACert(pem []byte) Option {
+	return func(c *Client) {
+		c.tlsOptions().caCert = pem
+	}
+}
+
+// WithClientCertificate presents the PEM encoded certificate and key to
+// APM Servers requiring mutual TLS.
+func WithClientCertificate(certPEM, keyPEM []byte) Option {
+	return func(c *Client) {
+		opts := c.tlsOptions()
+		opts.clientCert = certPEM
+		opts.clientKey = keyPEM
+	}
+}
+
+// WithServerCertFingerprint pins the hex encoded SHA-256 fingerprint of
+// the APM Server certificate, or of a CA of its chain. Connections to
+// servers presenting no matching certificate fail.
+func WithServerCertFingerprint(fingerprint string) Option {
+	return func(c *Client) {
+		c.tlsOptions().fingerprint = fingerprint
+	}
+}
+
+// WithInsecureSkipVerify disables the verification of the APM Server
+// certificate. It must only be used for testing.
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(c *Client) {
+		c.tlsOptions().insecureSkipVerify = skip
+	}
+}
+
+// WithSelfTelemetry enables adding a metricset describing the extension
+// itself to the data sent on each flush. The metricset is labelled with
+// the SelfTelemetrySource source.
+func WithSelfTelemetry(enabled bool) Option {
+	return func(c *Client) {
+		c.selfTelemetry = enabled
+	}
+}
+
+// WithLogsAPIDropped sets the function returning the number of records
+// and bytes dropped by the Logs API, reported in the self-telemetry.
+func WithLogsAPIDropped(f func() (records, bytes int64)) Option {
+	return func(c *Client) {
+		c.logsAPIDropped = f
+	}
+}
@@ -0,0 +1,194 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+	"github.com/elastic/apm-aws-lambda/otlp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codes of the google.rpc.Status returned in OTLP/HTTP error responses.
+const (
+	otlpCodeInvalidArgument = 3
+	otlpCodeUnimplemented   = 12
+	otlpCodeUnavailable     = 14
+)
+
+// otlpConverter converts the body of an OTLP/HTTP request to intake v2
+// payloads.
+type otlpConverter func(body []byte, enc otlp.Encoding, faas otlp.FAAS) ([][]byte, error)
+
+// URL: http://server/v1/traces, http://server/v1/metrics and http://server/v1/logs
+//
+// The data is converted to intake v2 and batched along with the data of
+// the Elastic agents. OpenTelemetry SDKs signal that they flushed their
+// data for the invocation with the flushed=true query parameter or the
+// X-Elastic-Flushed header, which can be set with OTEL_EXPORTER_OTLP_HEADERS.
+func (c *Client) handleOTLP(convert otlpConverter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Debugf("Handling OTLP request to %s", r.URL.Path)
+		defer r.Body.Close()
+
+		if r.URL.Query().Get("flushed") == "true" || r.Header.Get("X-Elastic-Flushed") == "true" {
+			// Signaled once the data is in the agent data channel.
+			defer c.signalFlush()
+		}
+
+		var enc otlp.Encoding
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-protobuf":
+			enc = otlp.Protobuf
+		case "application/json":
+			enc = otlp.JSON
+		default:
+			c.writeOTLPError(w, otlp.JSON, http.StatusUnsupportedMediaType, otlpCodeInvalidArgument, "unsupported content type: "+mediaType)
+			return
+		}
+		if r.Method != http.MethodPost {
+			c.writeOTLPError(w, enc, http.StatusMethodNotAllowed, otlpCodeUnimplemented, "only POST requests are supported")
+			return
+		}
+
+		body, err := c.readOTLPBody(r)
+		if err != nil {
+			if errors.Is(err, errBodyTooLarge) {
+				c.logger.Warnf("Rejecting OTLP request: %v", err)
+				c.writeOTLPError(w, enc, http.StatusRequestEntityTooLarge, otlpCodeInvalidArgument, err.Error())
+				return
+			}
+			c.logger.Errorf("Could not read OTLP request body: %v", err)
+			c.writeOTLPError(w, enc, http.StatusBadRequest, otlpCodeInvalidArgument, err.Error())
+			return
+		}
+
+		payloads, err := convert(body, enc, c.currentFAAS())
+		if err != nil {
+			c.logger.Warnf("Could not convert OTLP request to intake v2: %v", err)
+			c.writeOTLPError(w, enc, http.StatusBadRequest, otlpCodeInvalidArgument, err.Error())
+			return
+		}
+		// The payloads are rejected as a whole, so that the retry of the
+		// client doesn't duplicate the payloads already enqueued.
+		if c.backpressurePolicy == Reject && cap(c.AgentDataChannel)-len(c.AgentDataChannel) < len(payloads) {
+			c.logger.Warn("Channel full: rejecting OTLP data")
+			c.rejectPayloads(payloads)
+			w.Header().Set("Retry-After", defaultRetryAfterSeconds)
+			c.writeOTLPError(w, enc, http.StatusServiceUnavailable, otlpCodeUnavailable, "queue is full")
+			return
+		}
+		for i, p := range payloads {
+			if c.enqueueAgentData(r.Context(), accumulator.APMData{Data: p}) {
+				continue
+			}
+			if i == 0 {
+				w.Header().Set("Retry-After", defaultRetryAfterSeconds)
+				c.writeOTLPError(w, enc, http.StatusServiceUnavailable, otlpCodeUnavailable, "queue is full")
+				return
+			}
+			// Other requests took the room in the meantime, the remaining
+			// payloads are dropped rather than retried.
+			c.logger.Warnf("Channel full: dropping %d OTLP payloads", len(payloads)-i-1)
+			c.rejectPayloads(payloads[i+1:])
+			break
+		}
+
+		// The export responses are empty unless data is partially rejected.
+		if enc == otlp.JSON {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write([]byte("{}")); err != nil {
+				c.logger.Errorf("Failed to send OTLP response : %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// rejectPayloads records the events of the payloads as received and
+// rejected, for the agent to retry.
+func (c *Client) rejectPayloads(payloads [][]byte) {
+	for _, p := range payloads {
+		n := countEvents(accumulator.APMData{Data: p})
+		c.recordReceived(n)
+		c.recordRejected(n)
+	}
+}
+
+// readOTLPBody reads the, possibly compressed, body of an OTLP request
+// up to the maximum body size of the receiver.
+func (c *Client) readOTLPBody(r *http.Request) ([]byte, error) {
+	body, err := decodeBody(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	// Read one more byte than permitted to detect bodies that are too large.
+	data, err := io.ReadAll(io.LimitReader(body, c.receiverMaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.receiverMaxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// currentFAAS returns the invocation that OTLP data without faas
+// attributes is correlated with.
+func (c *Client) currentFAAS() otlp.FAAS {
+	if c.batch == nil {
+		return otlp.FAAS{}
+	}
+	inv, ok := c.batch.CurrentInvocation()
+	if !ok {
+		return otlp.FAAS{}
+	}
+	return otlp.FAAS{ID: inv.FunctionARN, Execution: inv.RequestID}
+}
+
+// writeOTLPError writes an error response with a google.rpc.Status body
+// as mandated by the OTLP/HTTP specification.
+func (c *Client) writeOTLPError(w http.ResponseWriter, enc otlp.Encoding, statusCode, code int, message string) {
+	var body []byte
+	if enc == otlp.JSON {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{code, message})
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		body = protowire.AppendTag(body, 1, protowire.VarintType)
+		body = protowire.AppendVarint(body, uint64(code))
+		body = protowire.AppendTag(body, 2, protowire.BytesType)
+		body = protowire.AppendString(body, message)
+	}
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(body); err != nil {
+		c.logger.Errorf("Failed to send OTLP response : %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+	"github.com/elastic/apm-aws-lambda/otlp"
+	"github.com/tidwall/gjson"
+	collogsv1 "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP compression algorithms.
+const (
+	OTLPCompressionGzip = "gzip"
+	OTLPCompressionNone = "none"
+)
+
+// otlpSignalPaths maps the intake v2 event types to the path of the OTLP
+// signal they are exported as, and otlpSignalOrder orders the signals as
+// they are posted.
+var (
+	otlpSignalPaths = map[string]string{
+		"transaction": "v1/traces",
+		"span":        "v1/traces",
+		"metricset":   "v1/metrics",
+		"log":         "v1/logs",
+		"error":       "v1/logs",
+	}
+	otlpSignalOrder = []string{"v1/traces", "v1/metrics", "v1/logs"}
+)
+
+// otlpOutput configures the client to send the data to the OTLP/HTTP
+// endpoints, instead of the intake v2 API of APM Server.
+type otlpOutput struct {
+	headers     map[string]string
+	compression string
+}
+
+// postOTLP converts the intake v2 data to OTLP and sends each signal to
+// the endpoints.
+func (c *Client) postOTLP(ctx context.Context, apmData accumulator.APMData) error {
+	data, err := accumulator.GetUncompressedBytes(apmData.Data, apmData.ContentEncoding)
+	if err != nil {
+		return fmt.Errorf("failed to decompress data: %w", err)
+	}
+	d, err := otlp.FromIntakeV2(data)
+	if err != nil {
+		return fmt.Errorf("failed to convert data to OTLP: %w", err)
+	}
+
+	type request struct {
+		path string
+		data proto.Message
+	}
+	var requests []request
+	if d.Traces != nil {
+		requests = append(requests, request{"v1/traces", d.Traces})
+	}
+	if d.Metrics != nil {
+		requests = append(requests, request{"v1/metrics", d.Metrics})
+	}
+	if d.Logs != nil {
+		requests = append(requests, request{"v1/logs", d.Logs})
+	}
+
+	for _, r := range requests {
+		body, err := c.encodeOTLP(r.data)
+		if err != nil {
+			return err
+		}
+		path := r.path
+		if err := c.postToEndpoints(func(e *endpoint) error {
+			return c.postOTLPToEndpoint(ctx, e, path, body)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitOTLPSignals splits the intake v2 data of a batch by the OTLP signal
+// its events are exported as, each part starting with the metadata. The
+// events of unknown types, which are not exported, are skipped.
+func splitOTLPSignals(data accumulator.BatchData) ([]accumulator.BatchData, error) {
+	raw, err := accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	metadata, events, _ := bytes.Cut(raw, []byte("\n"))
+
+	parts := make(map[string]*accumulator.BatchData, len(otlpSignalOrder))
+	for len(events) > 0 {
+		var event []byte
+		event, events, _ = bytes.Cut(events, []byte("\n"))
+		var path string
+		gjson.ParseBytes(event).ForEach(func(key, _ gjson.Result) bool {
+			path = otlpSignalPaths[key.Str]
+			// Events have a single key.
+			return false
+		})
+		if path == "" {
+			continue
+		}
+		part, ok := parts[path]
+		if !ok {
+			part = &accumulator.BatchData{APMData: accumulator.APMData{Data: append([]byte(nil), metadata...)}}
+			parts[path] = part
+		}
+		part.Data = append(append(part.Data, '\n'), event...)
+		part.Count++
+	}
+
+	split := make([]accumulator.BatchData, 0, len(parts))
+	for _, path := range otlpSignalOrder {
+		if part, ok := parts[path]; ok {
+			split = append(split, *part)
+		}
+	}
+	return split, nil
+}
+
+func (c *Client) encodeOTLP(m proto.Message) ([]byte, error) {
+	body, err := proto.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal OTLP data: %w", err)
+	}
+	if c.otlpOutput.compression != OTLPCompressionGzip {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gw.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write compressed data to buffer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Client) postOTLPToEndpoint(ctx context.Context, e *endpoint, path string, body []byte) error {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.serverURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		c.setCustomHeaders(req)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if c.otlpOutput.compression == OTLPCompressionGzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		for k, v := range c.otlpOutput.headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	}
+	return c.doWithRetry(ctx, e, newRequest, func(ctx context.Context, e *endpoint, resp *http.Response) {
+		c.handleOTLPResponse(ctx, e, path, resp)
+	})
+}
+
+// handleOTLPResponse updates the status of the endpoint's transport based
+// on the response to the export of the signal posted to path.
+func (c *Client) handleOTLPResponse(ctx context.Context, e *endpoint, path string, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.logger.Warnf("failed to read OTLP response body: %v", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if rejected, msg := otlpPartialSuccess(path, body); rejected > 0 || msg != "" {
+			c.logger.Warnf("OTLP endpoint rejected %d items: %s", rejected, msg)
+		}
+		c.updateStatus(ctx, e, Healthy)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		c.logger.Warnf("Transport has been rate limited: response status code: %d", resp.StatusCode)
+		c.updateStatus(ctx, e, RateLimited)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		c.logger.Warnf("Authentication with the OTLP endpoint failed: response status code: %d", resp.StatusCode)
+		c.updateStatus(ctx, e, Failing)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		c.logger.Warnf("client error: response status code: %d: %s", resp.StatusCode, otlpStatusMessage(body))
+		c.updateStatus(ctx, e, ClientFailing)
+	case resp.StatusCode >= 500:
+		c.logger.Warnf("failed to post data to OTLP endpoint: response status code: %d", resp.StatusCode)
+		c.updateStatus(ctx, e, Failing)
+	default:
+		c.logger.Warnf("unhandled status code: %d", resp.StatusCode)
+	}
+}
+
+// otlpPartialSuccess decodes the partial_success field of the response to
+// the export of the signal posted to path.
+func otlpPartialSuccess(path string, body []byte) (int64, string) {
+	switch path {
+	case "v1/traces":
+		var resp coltracev1.ExportTraceServiceResponse
+		if err := proto.Unmarshal(body, &resp); err == nil {
+			return resp.GetPartialSuccess().GetRejectedSpans(), resp.GetPartialSuccess().GetErrorMessage()
+		}
+	case "v1/metrics":
+		var resp colmetricsv1.ExportMetricsServiceResponse
+		if err := proto.Unmarshal(body, &resp); err == nil {
+			return resp.GetPartialSuccess().GetRejectedDataPoints(), resp.GetPartialSuccess().GetErrorMessage()
+		}
+	case "v1/logs":
+		var resp collogsv1.ExportLogsServiceResponse
+		if err := proto.Unmarshal(body, &resp); err == nil {
+			return resp.GetPartialSuccess().GetRejectedLogRecords(), resp.GetPartialSuccess().GetErrorMessage()
+		}
+	}
+	return 0, ""
+}
+
+// otlpStatusMessage decodes the message of the google.rpc.Status body of
+// an error response.
+func otlpStatusMessage(body []byte) string {
+	var status statuspb.Status
+	if err := proto.Unmarshal(body, &status); err != nil {
+		return ""
+	}
+	return status.GetMessage()
+}
@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collogsv1 "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPPartialSuccess(t *testing.T) {
+	for path, resp := range map[string]proto.Message{
+		"v1/traces": &coltracev1.ExportTraceServiceResponse{
+			PartialSuccess: &coltracev1.ExportTracePartialSuccess{RejectedSpans: 2, ErrorMessage: "invalid data"},
+		},
+		"v1/metrics": &colmetricsv1.ExportMetricsServiceResponse{
+			PartialSuccess: &colmetricsv1.ExportMetricsPartialSuccess{RejectedDataPoints: 2, ErrorMessage: "invalid data"},
+		},
+		"v1/logs": &collogsv1.ExportLogsServiceResponse{
+			PartialSuccess: &collogsv1.ExportLogsPartialSuccess{RejectedLogRecords: 2, ErrorMessage: "invalid data"},
+		},
+	} {
+		body, err := proto.Marshal(resp)
+		require.NoError(t, err)
+		rejected, msg := otlpPartialSuccess(path, body)
+		assert.Equal(t, int64(2), rejected, path)
+		assert.Equal(t, "invalid data", msg, path)
+	}
+
+	// An empty response is a full success.
+	rejected, msg := otlpPartialSuccess("v1/traces", nil)
+	assert.Zero(t, rejected)
+	assert.Empty(t, msg)
+}
+
+func TestOTLPStatusMessage(t *testing.T) {
+	body, err := proto.Marshal(&statuspb.Status{Code: 3, Message: "invalid trace id"})
+	require.NoError(t, err)
+	assert.Equal(t, "invalid trace id", otlpStatusMessage(body))
+	assert.Empty(t, otlpStatusMessage([]byte("not protobuf")))
+}
@@ -26,9 +26,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"time"
 
-	"github.com/elastic/apm-aws-lambda/accumulator"
+	"github.com/elastic/apm-aws-lambda/otlp"
 	"github.com/tidwall/gjson"
 )
 
@@ -43,76 +44,145 @@ func (c *Client) StartReceiver() error {
 		return err
 	}
 
-	mux.HandleFunc("/", handleInfoRequest)
-	mux.HandleFunc("/intake/v2/events", c.handleIntakeV2Events())
-	mux.HandleFunc("/register/transaction", c.handleTransactionRegistration())
+	mux.HandleFunc("/", c.withReceiverAuth(handleInfoRequest))
+	mux.HandleFunc("/intake/v2/events", c.withReceiverAuth(c.handleIntakeV2Events()))
+	mux.HandleFunc("/register/transaction", c.withReceiverAuth(c.handleTransactionRegistration()))
+	mux.HandleFunc("/extension/status", c.handleStatusRequest())
+	mux.HandleFunc("/v1/traces", c.withReceiverAuth(c.handleOTLP(otlp.ConvertTraces)))
+	mux.HandleFunc("/v1/metrics", c.withReceiverAuth(c.handleOTLP(otlp.ConvertMetrics)))
+	mux.HandleFunc("/v1/logs", c.withReceiverAuth(c.handleOTLP(otlp.ConvertLogs)))
 
 	c.receiver.Handler = mux
 
+	if c.receiverLoopbackOnly {
+		_, port, err := net.SplitHostPort(c.receiver.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse receiver addr %s: %w", c.receiver.Addr, err)
+		}
+		c.receiver.Addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
 	ln, err := net.Listen("tcp", c.receiver.Addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on addr %s", c.receiver.Addr)
 	}
 
-	go func() {
-		c.logger.Infof("Extension listening for apm data on %s", c.receiver.Addr)
-		if err = c.receiver.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			c.logger.Errorf("received error from http.Serve(): %v", err)
-		} else {
-			c.logger.Debug("server closed")
+	if c.receiverSocket != "" {
+		// Remove the socket left behind by a previous process, if any.
+		if err := os.Remove(c.receiverSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			ln.Close()
+			return fmt.Errorf("failed to remove stale socket %s: %w", c.receiverSocket, err)
+		}
+		socketLn, err := net.Listen("unix", c.receiverSocket)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("failed to listen on socket %s: %w", c.receiverSocket, err)
 		}
-	}()
+		go c.serve(socketLn, c.receiverSocket)
+	}
+
+	go c.serve(ln, c.receiver.Addr)
 	return nil
 }
 
-// Shutdown shutdowns the apm receiver gracefully.
+// serve serves the receiver on the listener until the receiver is shut down.
+func (c *Client) serve(ln net.Listener, addr string) {
+	c.logger.Infof("Extension listening for apm data on %s", addr)
+	if err := c.receiver.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		c.logger.Errorf("received error from http.Serve(): %v", err)
+	} else {
+		c.logger.Debug("server closed")
+	}
+}
+
+// Shutdown shutdowns the apm receiver gracefully and stops the pending
+// grace periods of the transport.
 func (c *Client) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	c.shutdownOnce.Do(func() { close(c.done) })
+	c.gracePeriods.Wait()
 	return c.receiver.Shutdown(ctx)
 }
 
 // URL: http://server/
 func (c *Client) handleInfoRequest() (func(w http.ResponseWriter, r *http.Request), error) {
-	// Init reverse proxy
-	parsedApmServerUrl, err := url.Parse(c.serverURL)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse APM server URL: %w", err)
+	if c.otlpOutput != nil {
+		// There is no APM Server to query the version from.
+		return func(w http.ResponseWriter, r *http.Request) {
+			c.writeIntakeError(w, http.StatusNotFound, "APM server info is not available with the OTLP output")
+		}, nil
 	}
 
-	reverseProxy := httputil.NewSingleHostReverseProxy(parsedApmServerUrl)
-
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport := c.client.Transport.(*http.Transport).Clone()
 	customTransport.ResponseHeaderTimeout = c.client.Timeout
-	reverseProxy.Transport = customTransport
 
-	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		// Don't update the status of the transport as it is possible that the extension
-		// is frozen while processing the request and context is canceled due to timeout.
-		c.logger.Errorf("Error querying version from the APM server: %v", err)
+	errorHandler := func(e *endpoint) func(w http.ResponseWriter, r *http.Request, err error) {
+		return func(w http.ResponseWriter, r *http.Request, err error) {
+			// Don't update the status of the transport as it is possible that the extension
+			// is frozen while processing the request and context is canceled due to timeout.
+			c.logger.Errorf("Error querying version from the APM server: %v", err)
+
+			if c.serveCachedInfo(e, w, r) {
+				c.logger.Warn("Serving cached APM server info")
+				return
+			}
 
+			// Server is unreachable, return StatusBadGateway (default behaviour) to avoid
+			// returning a Status OK.
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
 
-		// Server is unreachable, return StatusBadGateway (default behaviour) to avoid
-		// returning a Status OK.
-		w.WriteHeader(http.StatusBadGateway)
+	// Init a reverse proxy for each endpoint, requests are forwarded to
+	// the currently active endpoint.
+	type infoProxy struct {
+		serverURL    *url.URL
+		reverseProxy *httputil.ReverseProxy
+	}
+	proxies := make(map[*endpoint]infoProxy, len(c.endpoints))
+	for _, e := range c.endpoints {
+		e := e
+		parsedApmServerUrl, err := url.Parse(e.serverURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse APM server URL: %w", err)
+		}
+
+		reverseProxy := httputil.NewSingleHostReverseProxy(parsedApmServerUrl)
+		reverseProxy.Transport = customTransport
+		reverseProxy.ErrorHandler = errorHandler(e)
+		reverseProxy.ModifyResponse = func(resp *http.Response) error {
+			return c.cacheInfoResponse(e, resp)
+		}
+		proxies[e] = infoProxy{serverURL: parsedApmServerUrl, reverseProxy: reverseProxy}
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		c.logger.Debug("Handling APM server Info Request")
 
+		// The prefetched info is served without a round trip to the APM
+		// server while it is fresh.
+		e, _ := c.activeEndpoint()
+		if c.infoPrefetch && c.serveCachedInfo(e, w, r) {
+			return
+		}
+
+		proxy := proxies[e]
+
 		// Process request (the Golang doc suggests removing any pre-existing X-Forwarded-For header coming
 		// from the client or an untrusted proxy to prevent IP spoofing : https://pkg.go.dev/net/http/httputil#ReverseProxy
 		r.Header.Del("X-Forwarded-For")
 
 		// Update headers to allow for SSL redirection
-		r.URL.Host = parsedApmServerUrl.Host
-		r.URL.Scheme = parsedApmServerUrl.Scheme
+		r.URL.Host = proxy.serverURL.Host
+		r.URL.Scheme = proxy.serverURL.Scheme
 		r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-		r.Host = parsedApmServerUrl.Host
+		r.Host = proxy.serverURL.Host
+		c.setProxyHeaders(r)
 
 		// Forward request to the APM server
-		reverseProxy.ServeHTTP(w, r)
+		proxy.reverseProxy.ServeHTTP(w, r)
 	}, nil
 }
 
@@ -120,46 +190,42 @@ func (c *Client) handleInfoRequest() (func(w http.ResponseWriter, r *http.Reques
 func (c *Client) handleIntakeV2Events() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		c.logger.Debug("Handling APM Data Intake")
-		rawBytes, err := io.ReadAll(r.Body)
 		defer r.Body.Close()
+
+		agentFlushed := r.URL.Query().Get("flushed") == "true"
+
+		agentData, dropped, err := c.readIntakeBody(r)
 		if err != nil {
+			// The agent is done with the invocation even if its data
+			// is rejected, don't wait for it.
+			if agentFlushed {
+				c.signalFlush()
+			}
+			if errors.Is(err, errBodyTooLarge) || errors.Is(err, errMetadataTooLarge) {
+				c.logger.Warnf("Rejecting agent intake request: %v", err)
+				c.writeIntakeError(w, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
 			c.logger.Errorf("Could not read agent intake request body: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		agentFlushed := r.URL.Query().Get("flushed") == "true"
-
-		agentData := accumulator.APMData{
-			Data:            rawBytes,
-			ContentEncoding: r.Header.Get("Content-Encoding"),
+		if dropped > 0 {
+			c.logger.Warnf("Dropped %d agent events exceeding the maximum event size of %d bytes", dropped, c.receiverMaxEventSize)
+			c.recordReceived(dropped)
+			c.recordDropped(DroppedEventTooLarge, dropped)
 		}
 
-		if len(agentData.Data) != 0 {
-			select {
-			case c.AgentDataChannel <- agentData:
-			default:
-				c.logger.Warnf("Channel full: dropping a subset of agent data")
-			}
-		}
+		accepted := len(agentData.Data) == 0 || c.enqueueAgentData(r.Context(), agentData)
 
 		if agentFlushed {
-			c.flushMutex.Lock()
-
-			select {
-			case <-c.flushCh:
-				// the channel is closed.
-				// the extension received at least a flush request already but the
-				// data have not been flushed yet.
-				// We can reuse the closed channel.
-			default:
-				// no pending flush requests
-				// close the channel to signal a flush request has
-				// been received.
-				close(c.flushCh)
-			}
+			c.signalFlush()
+		}
 
-			c.flushMutex.Unlock()
+		if !accepted {
+			w.Header().Set("Retry-After", defaultRetryAfterSeconds)
+			c.writeIntakeError(w, http.StatusServiceUnavailable, "queue is full")
+			return
 		}
 
 		w.WriteHeader(http.StatusAccepted)
@@ -169,6 +235,26 @@ func (c *Client) handleIntakeV2Events() func(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// signalFlush signals that the agent has flushed its data for the
+// current invocation.
+func (c *Client) signalFlush() {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	select {
+	case <-c.flushCh:
+		// the channel is closed.
+		// the extension received at least a flush request already but the
+		// data have not been flushed yet.
+		// We can reuse the closed channel.
+	default:
+		// no pending flush requests
+		// close the channel to signal a flush request has
+		// been received.
+		close(c.flushCh)
+	}
+}
+
 // URL: http://server/register/transaction
 func (c *Client) handleTransactionRegistration() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -19,14 +19,21 @@ package apmproxy_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/elastic/apm-aws-lambda/accumulator"
 	"github.com/elastic/apm-aws-lambda/apmproxy"
 
 	"github.com/stretchr/testify/assert"
@@ -88,6 +95,42 @@ func TestInfoProxy(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 }
 
+func TestInfoProxyFailover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`{"version": "secondary"}`))
+		require.NoError(t, err)
+	}))
+	defer secondary.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(primary.URL, secondary.URL),
+		apmproxy.WithReceiverAddress(":1236"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// Mark the primary endpoint as failing
+	apmClient.UpdateStatus(context.Background(), apmproxy.Failing)
+
+	hosts, _ := net.LookupHost("localhost")
+	resp, err := http.Get("http://" + hosts[0] + ":1236")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"version": "secondary"}`, string(body))
+}
+
 func TestInfoProxyErrorStatusCode(t *testing.T) {
 	// Create apm server and handler
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -331,3 +374,616 @@ func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 		t.Fatal("Timed out waiting for server to send flush signal")
 	}
 }
+
+func TestExtensionStatus(t *testing.T) {
+	batch := accumulator.NewBatch(10, time.Minute)
+	batch.RegisterInvocation("test-req-id", "arn:aws:lambda:us-east-1:123456789012:function:test", time.Now().Add(time.Minute).UnixMilli(), time.Now())
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs("https://primary.example.com", "https://secondary.example.com"),
+		apmproxy.WithReceiverAddress(":1237"),
+		apmproxy.WithBatch(batch),
+		apmproxy.WithAgentDataBufferSize(10),
+		apmproxy.WithLogsAPIState(func() string { return "subscribed" }),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(`{"metadata":{}}`)}
+	apmClient.UpdateStatus(context.Background(), apmproxy.Failing)
+
+	hosts, _ := net.LookupHost("localhost")
+	resp, err := http.Get("http://" + hosts[0] + ":1237/extension/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var status apmproxy.ExtensionStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+
+	// The status of the active endpoint is reported at the top level.
+	assert.Equal(t, apmproxy.Failing, status.Status)
+	assert.Equal(t, 0, status.ReconnectionCount)
+	assert.LessOrEqual(t, status.GracePeriodRemainingMs, int64(5000))
+	require.Len(t, status.Endpoints, 2)
+	assert.Equal(t, "https://primary.example.com/", status.Endpoints[0].URL)
+	assert.True(t, status.Endpoints[0].Active)
+	assert.Equal(t, apmproxy.Started, status.Endpoints[1].Status)
+	assert.False(t, status.Endpoints[1].Active)
+	assert.Equal(t, apmproxy.ChannelStatus{Len: 1, Cap: 10}, status.AgentData)
+	assert.Equal(t, apmproxy.ChannelStatus{Len: 0, Cap: 100}, status.LambdaData)
+	assert.Equal(t, apmproxy.BatchStatus{PendingInvocations: 1}, status.Batch)
+	assert.Equal(t, "subscribed", status.LogsAPI)
+}
+
+func Test_handleIntakeV2EventsTooLarge(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1238"),
+		apmproxy.WithReceiverMaxBodySize(64),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1238/intake/v2/events?flushed=true"
+
+	body := `{"metadata":{}}` + "\n" + `{"transaction":{"name":"` + strings.Repeat("x", 64) + `"}}`
+	resp, err := http.Post(url, "application/x-ndjson", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"accepted":0,"errors":[{"message":"request body exceeded the permitted size"}]}`, string(respBody))
+	assert.Len(t, apmClient.AgentDataChannel, 0)
+
+	// The agent flush is still honored
+	select {
+	case <-apmClient.WaitForFlush():
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func Test_handleIntakeV2EventsDropsLargeEvents(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1239"),
+		apmproxy.WithReceiverMaxEventSize(32),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1239/intake/v2/events"
+
+	events := []string{
+		`{"metadata":{}}`,
+		`{"span":{"id":"1"}}`,
+		`{"transaction":{"name":"` + strings.Repeat("x", 8192) + `"}}`,
+		"",
+		`{"span":{"id":"2"}}`,
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err = gw.Write([]byte(strings.Join(events, "\n") + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case agentData := <-apmClient.AgentDataChannel:
+		assert.Equal(t, `{"metadata":{}}`+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"span":{"id":"2"}}`, string(agentData.Data))
+		assert.Empty(t, agentData.ContentEncoding)
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func Test_handleIntakeV2EventsBackpressure(t *testing.T) {
+	oldest := `{"metadata":{}}` + "\n" + `{"span":{"id":"1"}}`
+	newest := `{"metadata":{}}` + "\n" + `{"span":{"id":"2"}}` + "\n" + `{"span":{"id":"3"}}`
+
+	for i, tc := range []struct {
+		policy           apmproxy.BackpressurePolicy
+		expectedStatus   int
+		expectedData     string
+		expectedDrops    map[string]int
+		expectedRejected int
+	}{
+		{
+			policy:         apmproxy.DropNewest,
+			expectedStatus: http.StatusAccepted,
+			expectedData:   oldest,
+			expectedDrops:  map[string]int{apmproxy.DroppedChannelFull: 2},
+		},
+		{
+			policy:         apmproxy.DropOldest,
+			expectedStatus: http.StatusAccepted,
+			expectedData:   newest,
+			expectedDrops:  map[string]int{apmproxy.DroppedEvicted: 1},
+		},
+		{
+			policy:         apmproxy.Block,
+			expectedStatus: http.StatusAccepted,
+			expectedData:   oldest,
+			expectedDrops:  map[string]int{apmproxy.DroppedBlockTimeout: 2},
+		},
+		{
+			policy:           apmproxy.Reject,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedData:     oldest,
+			expectedDrops:    map[string]int{},
+			expectedRejected: 2,
+		},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			addr := fmt.Sprintf(":%d", 1240+i)
+			apmClient, err := apmproxy.NewClient(
+				apmproxy.WithURL("https://example.com"),
+				apmproxy.WithReceiverAddress(addr),
+				apmproxy.WithAgentDataBufferSize(1),
+				apmproxy.WithBackpressurePolicy(tc.policy),
+				apmproxy.WithBackpressureTimeout(10*time.Millisecond),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			)
+			require.NoError(t, err)
+			require.NoError(t, apmClient.StartReceiver())
+			defer func() {
+				require.NoError(t, apmClient.Shutdown())
+			}()
+
+			apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(oldest)}
+
+			hosts, _ := net.LookupHost("localhost")
+			resp, err := http.Post("http://"+hosts[0]+addr+"/intake/v2/events", "application/x-ndjson", strings.NewReader(newest))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+			}
+
+			require.Len(t, apmClient.AgentDataChannel, 1)
+			assert.Equal(t, tc.expectedData, string((<-apmClient.AgentDataChannel).Data))
+			assert.Equal(t, tc.expectedDrops, apmClient.DroppedEvents())
+			assert.Equal(t, tc.expectedRejected, apmClient.RejectedEvents())
+		})
+	}
+}
+
+func Test_handleIntakeV2EventsAuth(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1244"),
+		apmproxy.WithReceiverLoopbackOnly(true),
+		apmproxy.WithReceiverAuth("secret", "key"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	for _, tc := range []struct {
+		authorization  string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"accepted":0,"errors":[{"message":"authentication failed: missing or improperly formatted Authorization header"}]}`,
+		},
+		{
+			authorization:  "Bearer wrong",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"accepted":0,"errors":[{"message":"authentication failed: invalid credentials"}]}`,
+		},
+		{
+			authorization:  "ApiKey secret",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"accepted":0,"errors":[{"message":"authentication failed: invalid credentials"}]}`,
+		},
+		{
+			authorization:  "Bearer secret",
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			authorization:  "ApiKey key",
+			expectedStatus: http.StatusAccepted,
+		},
+	} {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:1244/intake/v2/events", strings.NewReader(`{"metadata":{}}`))
+		require.NoError(t, err)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, tc.expectedStatus, resp.StatusCode, tc.authorization)
+		if tc.expectedBody != "" {
+			assert.JSONEq(t, tc.expectedBody, string(body))
+		}
+	}
+	// Only the authorized requests made it through
+	assert.Len(t, apmClient.AgentDataChannel, 2)
+
+	// The info requests are authenticated too
+	resp, err := http.Get("http://127.0.0.1:1244")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestReceiverSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "elastic-apm.sock")
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1245"),
+		apmproxy.WithReceiverSocket(socket),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	resp, err := client.Post("http://unix/intake/v2/events", "application/x-ndjson", strings.NewReader(`{"metadata":{}}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Len(t, apmClient.AgentDataChannel, 1)
+
+	// The status endpoint is available on the socket as well
+	resp, err = client.Get("http://unix/extension/status")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The TCP listener is still available
+	resp, err = http.Post("http://127.0.0.1:1245/intake/v2/events", "application/x-ndjson", strings.NewReader(`{"metadata":{}}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Len(t, apmClient.AgentDataChannel, 2)
+}
+
+func TestInfoProxyCache(t *testing.T) {
+	var failing atomic.Bool
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"version": "8.0.0"}`))
+		require.NoError(t, err)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1246"),
+		apmproxy.WithInfoCacheTTL(time.Minute),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	getInfo := func() (int, string) {
+		resp, err := http.Get("http://127.0.0.1:1246")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := getInfo()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"version": "8.0.0"}`, body)
+
+	// Server errors are hidden by the cached response
+	failing.Store(true)
+	status, body = getInfo()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"version": "8.0.0"}`, body)
+
+	// So is an unreachable server
+	apmServer.Close()
+	status, body = getInfo()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"version": "8.0.0"}`, body)
+}
+
+func TestInfoPrefetch(t *testing.T) {
+	var requests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, err := w.Write([]byte(`{"version": "8.0.0"}`))
+		require.NoError(t, err)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithSecretToken("foo"),
+		apmproxy.WithReceiverAddress(":1247"),
+		apmproxy.WithInfoPrefetch(true),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	require.NoError(t, apmClient.PrefetchInfo(context.Background()))
+	assert.Equal(t, int32(1), requests.Load())
+
+	getInfo := func(authorization string) {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:1247", nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `{"version": "8.0.0"}`, string(body))
+	}
+
+	// The agent request with the credentials of the extension is served
+	// from the cache
+	getInfo("Bearer foo")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Other requests are forwarded to the APM server
+	getInfo("")
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestInfoPrefetchFailover(t *testing.T) {
+	newServer := func(version string, intakeStatus int) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/intake/v2/events" {
+				w.WriteHeader(intakeStatus)
+				return
+			}
+			_, err := w.Write([]byte(`{"version": "` + version + `"}`))
+			require.NoError(t, err)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	primary := newServer("8.0.0", http.StatusServiceUnavailable)
+	secondary := newServer("8.1.0", http.StatusAccepted)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(primary.URL, secondary.URL),
+		apmproxy.WithSecretToken("foo"),
+		apmproxy.WithReceiverAddress(":1251"),
+		apmproxy.WithInfoPrefetch(true),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+	require.NoError(t, apmClient.PrefetchInfo(context.Background()))
+
+	// Fail over to the secondary server
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte(`{"metadata":{}}`)}))
+
+	// The info cached for the primary server is not served
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:1251", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer foo")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, `{"version": "8.1.0"}`, string(body))
+}
+
+func TestReceiverOTLP(t *testing.T) {
+	batch := accumulator.NewBatch(100, time.Minute)
+	batch.RegisterInvocation("req-1", "arn:aws:lambda:us-east-1:123456789012:function:checkout", time.Now().Add(time.Minute).UnixMilli(), time.Now())
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1248"),
+		apmproxy.WithBatch(batch),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	traces := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},` +
+		`"scopeSpans":[{"spans":[{"traceId":"5b8efef142334f5a9d3b112c2f3d4e5f","spanId":"0102030405060708",` +
+		`"name":"handler","kind":2,"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000100000000"}]}]}]}`
+
+	for _, tc := range []struct {
+		name           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "unsupported content type",
+			contentType:    "text/plain",
+			body:           traces,
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedBody:   `{"code":3,"message":"unsupported content type: text/plain"}`,
+		},
+		{
+			name:           "invalid body",
+			contentType:    "application/json",
+			body:           `{"resourceSpans":`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "traces",
+			contentType:    "application/json",
+			body:           traces,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost:1248/v1/traces", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, string(body))
+			}
+		})
+	}
+
+	require.Len(t, apmClient.AgentDataChannel, 1)
+	agentData := <-apmClient.AgentDataChannel
+	lines := strings.Split(string(agentData.Data), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"name":"checkout"`)
+	assert.Contains(t, lines[1], `"execution":"req-1"`)
+
+	// The flush is signaled once the data is enqueued.
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:1248/v1/logs", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Elastic-Flushed", "true")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	select {
+	case <-apmClient.WaitForFlush():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for server to send flush signal")
+	}
+}
+
+func TestReceiverOTLPBackpressure(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithReceiverAddress(":1252"),
+		apmproxy.WithAgentDataBufferSize(2),
+		apmproxy.WithBackpressurePolicy(apmproxy.Reject),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	resourceSpans := func(service string) string {
+		return `{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"` + service + `"}}]},` +
+			`"scopeSpans":[{"spans":[{"traceId":"5b8efef142334f5a9d3b112c2f3d4e5f","spanId":"0102030405060708",` +
+			`"name":"handler","kind":2,"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000100000000"}]}]}`
+	}
+	traces := `{"resourceSpans":[` + resourceSpans("checkout") + `,` + resourceSpans("cart") + `]}`
+	post := func() int {
+		resp, err := http.Post("http://localhost:1252/v1/traces", "application/json", strings.NewReader(traces))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// The payloads of both resources are rejected as there is room for
+	// only one of them.
+	apmClient.AgentDataChannel <- accumulator.APMData{Data: []byte(`{"metadata":{}}`)}
+	assert.Equal(t, http.StatusServiceUnavailable, post())
+	assert.Len(t, apmClient.AgentDataChannel, 1)
+	assert.Equal(t, 2, apmClient.RejectedEvents())
+	assert.Empty(t, apmClient.DroppedEvents())
+
+	<-apmClient.AgentDataChannel
+	assert.Equal(t, http.StatusOK, post())
+	assert.Len(t, apmClient.AgentDataChannel, 2)
+}
+func TestInfoProxyCustomHeaders(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "tenant-a", r.Header.Get("X-Tenant"))
+		assert.Equal(t, "agent/1.0 apm-aws-lambda/1.2.0 (python3.9)", r.UserAgent())
+		_, err := w.Write([]byte(`{"version":"8.5.0"}`))
+		require.NoError(t, err)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1249"),
+		apmproxy.WithHeaders(map[string]string{"X-Tenant": "tenant-a"}),
+		apmproxy.WithFunctionRuntime("python3.9"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:1249", nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "agent/1.0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts int           = 1
+	defaultRetryBackoff     time.Duration = 100 * time.Millisecond
+	defaultRetryMaxBackoff  time.Duration = 2 * time.Second
+)
+
+// retryDelay returns the time to wait before attempting a request again
+// and whether the request should be retried at all. A request is retried
+// only for transient failures, i.e. connection resets and 429, 502, 503
+// and 504 responses, as long as the maximum number of attempts is not
+// reached and the retry can happen before the context deadline.
+func (c *Client) retryDelay(ctx context.Context, attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt >= c.retryMaxAttempts {
+		return 0, false
+	}
+
+	var delay time.Duration
+	switch {
+	case err != nil:
+		if !isConnectionReset(err) {
+			return 0, false
+		}
+		delay = c.backoff(attempt)
+	case isRetryableStatus(resp.StatusCode):
+		delay = c.backoff(attempt)
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			delay = retryAfter
+			if delay > c.retryMaxBackoff {
+				delay = c.retryMaxBackoff
+			}
+		}
+	default:
+		return 0, false
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		c.logger.Debugf("Not retrying request, delay of %s exceeds the remaining time", delay)
+		return 0, false
+	}
+	return delay, true
+}
+
+// backoff computes an exponential backoff for the given attempt with
+// jitter in the range [d/2, d).
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.retryBackoff << (attempt - 1)
+	if d <= 0 || d > c.retryMaxBackoff {
+		d = c.retryMaxBackoff
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter parses the value of a Retry-After header which can
+// either be a number of seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
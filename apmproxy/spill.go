@@ -0,0 +1,231 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+)
+
+const (
+	spillSegmentSuffix = ".ndjson.gz"
+	spillTempSuffix    = ".tmp"
+)
+
+// errSpillSegmentTooLarge is returned when a single segment is larger
+// than the maximum size of the spill queue.
+var errSpillSegmentTooLarge = errors.New("segment exceeds spill queue capacity")
+
+// spillQueue is a bounded, on-disk FIFO queue of batches that could not be
+// delivered to the APM Server. Each batch is written as a separate gzip
+// compressed ndjson segment, including the metadata line, so that it can be
+// replayed as-is once the transport recovers. When the queue runs out of
+// capacity the oldest segments are evicted first.
+type spillQueue struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	size     int64
+	segments []spillSegment
+	nextSeq  uint64
+}
+
+type spillSegment struct {
+	seq  uint64
+	size int64
+}
+
+// newSpillQueue creates a spill queue backed by dir. Segments left behind
+// in dir by a previous process are picked up and will be replayed first.
+func newSpillQueue(dir string, maxSize int64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spill directory %s: %w", dir, err)
+	}
+
+	q := &spillQueue{dir: dir, maxSize: maxSize}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, spillTempSuffix) {
+			// Partially written segment, most likely the process was
+			// killed while writing it.
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, spillSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spillSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, spillSegment{seq: seq, size: info.Size()})
+		q.size += info.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+	if n := len(q.segments); n > 0 {
+		q.nextSeq = q.segments[n-1].seq + 1
+	}
+	return q, nil
+}
+
+// Push writes the data as a new segment at the tail of the queue. The
+// oldest segments are evicted if needed to stay within the maximum size.
+// The number of evicted segments is returned.
+func (q *spillQueue) Push(data accumulator.APMData) (int, error) {
+	// Data that is already gzip encoded is written as is.
+	body, compressed := data.Data, data.ContentEncoding == "gzip"
+	if !compressed {
+		var err error
+		if body, err = accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding); err != nil {
+			return 0, err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seq := q.nextSeq
+	q.nextSeq++
+	path := q.segmentPath(seq)
+	tmpPath := path + spillTempSuffix
+	size, err := writeSpillSegment(tmpPath, body, compressed)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+	if size > q.maxSize {
+		_ = os.Remove(tmpPath)
+		return 0, errSpillSegmentTooLarge
+	}
+
+	var evicted int
+	for len(q.segments) > 0 && q.size+size > q.maxSize {
+		if err := q.removeHead(); err != nil {
+			_ = os.Remove(tmpPath)
+			return evicted, err
+		}
+		evicted++
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return evicted, fmt.Errorf("failed to commit spill segment: %w", err)
+	}
+	q.segments = append(q.segments, spillSegment{seq: seq, size: size})
+	q.size += size
+	return evicted, nil
+}
+
+// Peek returns the oldest segment in the queue without removing it.
+func (q *spillQueue) Peek() (accumulator.APMData, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.segments) == 0 {
+		return accumulator.APMData{}, errors.New("spill queue is empty")
+	}
+	data, err := os.ReadFile(q.segmentPath(q.segments[0].seq))
+	if err != nil {
+		return accumulator.APMData{}, fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	return accumulator.APMData{Data: data, ContentEncoding: "gzip"}, nil
+}
+
+// Pop removes the oldest segment from the queue.
+func (q *spillQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.segments) == 0 {
+		return nil
+	}
+	return q.removeHead()
+}
+
+// Len returns the number of segments in the queue.
+func (q *spillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.segments)
+}
+
+func (q *spillQueue) removeHead() error {
+	head := q.segments[0]
+	if err := os.Remove(q.segmentPath(head.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spill segment: %w", err)
+	}
+	q.segments = q.segments[1:]
+	q.size -= head.size
+	return nil
+}
+
+func (q *spillQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, spillSegmentSuffix))
+}
+
+func writeSpillSegment(path string, data []byte, compressed bool) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create spill segment: %w", err)
+	}
+	defer f.Close()
+
+	if compressed {
+		if _, err := f.Write(data); err != nil {
+			return 0, fmt.Errorf("failed to write spill segment: %w", err)
+		}
+	} else {
+		gw, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := gw.Write(data); err != nil {
+			return 0, fmt.Errorf("failed to compress spill segment: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return 0, fmt.Errorf("failed to write spill segment: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync spill segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
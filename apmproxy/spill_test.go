@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillQueueOrder(t *testing.T) {
+	q, err := newSpillQueue(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		evicted, err := q.Push(accumulator.APMData{Data: []byte(fmt.Sprintf("segment-%d", i))})
+		require.NoError(t, err)
+		require.Equal(t, 0, evicted)
+	}
+	require.Equal(t, 3, q.Len())
+
+	for i := 0; i < 3; i++ {
+		data, err := q.Peek()
+		require.NoError(t, err)
+		assert.Equal(t, "gzip", data.ContentEncoding)
+		raw, err := accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("segment-%d", i), string(raw))
+		require.NoError(t, q.Pop())
+	}
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestSpillQueueEviction(t *testing.T) {
+	q, err := newSpillQueue(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	_, err = q.Push(accumulator.APMData{Data: []byte("first")})
+	require.NoError(t, err)
+
+	// Shrink the queue so that it can hold exactly one segment.
+	q.maxSize = q.size
+	evicted, err := q.Push(accumulator.APMData{Data: []byte("other")})
+	require.NoError(t, err)
+	assert.Equal(t, 1, evicted)
+	assert.Equal(t, 1, q.Len())
+
+	data, err := q.Peek()
+	require.NoError(t, err)
+	raw, err := accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding)
+	require.NoError(t, err)
+	assert.Equal(t, "other", string(raw))
+
+	q.maxSize = 1
+	_, err = q.Push(accumulator.APMData{Data: []byte("too large")})
+	assert.ErrorIs(t, err, errSpillSegmentTooLarge)
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestSpillQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newSpillQueue(dir, 1<<20)
+	require.NoError(t, err)
+	for _, s := range []string{"a", "b"} {
+		_, err := q.Push(accumulator.APMData{Data: []byte(s)})
+		require.NoError(t, err)
+	}
+
+	reloaded, err := newSpillQueue(dir, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, 2, reloaded.Len())
+	assert.Equal(t, q.size, reloaded.size)
+
+	_, err = reloaded.Push(accumulator.APMData{Data: []byte("c")})
+	require.NoError(t, err)
+	for _, expected := range []string{"a", "b", "c"} {
+		data, err := reloaded.Peek()
+		require.NoError(t, err)
+		raw, err := accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(raw))
+		require.NoError(t, reloaded.Pop())
+	}
+}
@@ -0,0 +1,287 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+)
+
+var newLineSep = []byte("\n")
+
+const (
+	defaultStreamMaxSize int           = 768 * 1024
+	defaultStreamMaxAge  time.Duration = 10 * time.Second
+)
+
+// intakeStream is a long-lived, chunked and gzip compressed request to the
+// intake endpoint of an APM Server. The metadata is written when the stream
+// is opened and events are written to the request body as they are shipped.
+// The request completes, and the response is available, once the stream is
+// closed. The events are only delivered once APM Server has responded.
+type intakeStream struct {
+	endpoint *endpoint
+	// metadata is the metadata the stream was opened with.
+	metadata []byte
+	pw       *io.PipeWriter
+	sent     *countingWriter
+	gw       *gzip.Writer
+	cancel   context.CancelFunc
+	opened   time.Time
+	// size is the number of uncompressed bytes written to the stream.
+	size int
+	// pending holds a copy of the data written to the stream, if it can
+	// be spilled on failure, and pendingCount the number of its events.
+	pending      []accumulator.APMData
+	pendingCount int
+
+	done chan struct{}
+	resp *http.Response
+	err  error
+}
+
+// openStream starts a new streaming request to the active endpoint.
+func (c *Client) openStream(metadata []byte) (*intakeStream, error) {
+	e, ok := c.activeEndpoint()
+	if !ok {
+		return nil, errors.New("transport status is unhealthy")
+	}
+
+	// The request is not bound to the invocation as it is expected to
+	// outlive it, it is cancelled explicitly if the stream fails.
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.serverURL+intakeEndpointURI, pr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create a new stream request to APM server: %v", err)
+	}
+	c.setIntakeHeaders(req, "gzip")
+
+	sent := &countingWriter{w: pw}
+	gw, err := gzip.NewWriterLevel(sent, gzip.BestSpeed)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := &intakeStream{
+		endpoint: e,
+		metadata: append([]byte(nil), metadata...),
+		pw:       pw,
+		sent:     sent,
+		gw:       gw,
+		cancel:   cancel,
+		opened:   time.Now(),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		// The stream can stay open for up to the max age, extend the
+		// data forwarder timeout accordingly for the whole request.
+		client := &http.Client{
+			Transport: c.client.Transport,
+			Timeout:   c.streamMaxAge + c.client.Timeout,
+		}
+		s.resp, s.err = client.Do(req)
+		if s.err != nil {
+			// Unblock any pending write to the stream.
+			pr.CloseWithError(s.err)
+		}
+	}()
+
+	c.logger.Debugf("Opened intake stream to APM server %s", e.serverURL)
+	if err := s.write(metadata); err != nil {
+		s.abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+// write writes an ndjson chunk to the stream and flushes it to the network.
+func (s *intakeStream) write(data []byte) error {
+	if s.size > 0 {
+		if _, err := s.gw.Write(newLineSep); err != nil {
+			return fmt.Errorf("failed to write to intake stream: %w", err)
+		}
+	}
+	n, err := s.gw.Write(data)
+	s.size += n
+	if err != nil {
+		return fmt.Errorf("failed to write to intake stream: %w", err)
+	}
+	if err := s.gw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush intake stream: %w", err)
+	}
+	return nil
+}
+
+func (s *intakeStream) abort() {
+	s.cancel()
+	s.pw.CloseWithError(errors.New("intake stream aborted"))
+	<-s.done
+	if s.resp != nil {
+		s.resp.Body.Close()
+	}
+}
+
+// streamBatch writes the events in the batch to the intake stream, opening
+// a new stream if required. The stream is rotated if it has reached its
+// maximum size or age, or if the events have a different metadata.
+func (c *Client) streamBatch(ctx context.Context) error {
+	if c.batch == nil || c.batch.Count() == 0 {
+		return nil
+	}
+	defer c.batch.Reset()
+
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	var firstErr error
+	for _, data := range c.batch.ToAPMData() {
+		if data.Count == 0 {
+			continue
+		}
+		if err := c.streamData(ctx, data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Client) streamData(ctx context.Context, data accumulator.BatchData) error {
+	// The data always starts with the metadata which is only written
+	// once, when the stream is opened.
+	raw, err := accumulator.GetUncompressedBytes(data.Data, data.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	metadata, events, _ := bytes.Cut(raw, newLineSep)
+
+	if c.stream != nil && !bytes.Equal(c.stream.metadata, metadata) {
+		c.logger.Debug("Intake stream metadata changed")
+		if err := c.closeStreamLocked(ctx); err != nil {
+			c.logger.Warnf("Failed to close intake stream: %v", err)
+		}
+	}
+	if c.stream != nil && time.Since(c.stream.opened) >= c.streamMaxAge {
+		c.logger.Debug("Intake stream reached max age")
+		if err := c.closeStreamLocked(ctx); err != nil {
+			c.logger.Warnf("Failed to close intake stream: %v", err)
+		}
+	}
+	if c.stream == nil {
+		stream, err := c.openStream(metadata)
+		if err != nil {
+			c.spillData(data.APMData)
+			return err
+		}
+		c.stream = stream
+	}
+	if err := c.stream.write(events); err != nil {
+		c.stream.abort()
+		if c.stream.err != nil {
+			c.updateStatus(ctx, c.stream.endpoint, Failing)
+		}
+		c.spillStream(c.stream)
+		c.stream = nil
+		c.spillData(data.APMData)
+		return err
+	}
+	c.stream.pendingCount += data.Count
+	if c.spill != nil {
+		// The data of the batch is reused once the batch is reset.
+		c.stream.pending = append(c.stream.pending, accumulator.APMData{
+			Data:            append([]byte(nil), data.Data...),
+			ContentEncoding: data.ContentEncoding,
+		})
+	}
+	if c.stream.size >= c.streamMaxSize {
+		c.logger.Debug("Intake stream reached max size")
+		return c.closeStreamLocked(ctx)
+	}
+	return nil
+}
+
+// CloseStream completes the intake stream, if any, and waits for the
+// response from APM Server. It must be called before the extension is
+// frozen as the connection would not survive the freeze.
+func (c *Client) CloseStream(ctx context.Context) error {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return c.closeStreamLocked(ctx)
+}
+
+func (c *Client) closeStreamLocked(ctx context.Context) error {
+	s := c.stream
+	if s == nil {
+		return nil
+	}
+	c.stream = nil
+
+	if err := s.gw.Close(); err != nil {
+		s.abort()
+		c.spillStream(s)
+		return fmt.Errorf("failed to close intake stream: %w", err)
+	}
+	s.pw.Close()
+
+	timer := time.NewTimer(c.client.Timeout)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+	case <-timer.C:
+		s.abort()
+		c.updateStatus(ctx, s.endpoint, Failing)
+		c.spillStream(s)
+		return errors.New("timed out waiting for intake stream response")
+	}
+	defer s.cancel()
+
+	if s.err != nil {
+		c.updateStatus(ctx, s.endpoint, Failing)
+		c.spillStream(s)
+		return fmt.Errorf("failed to stream to APM server: %v", s.err)
+	}
+	defer s.resp.Body.Close()
+	c.recordBytesSent(s.sent.n)
+	c.logger.Debugf("Closed intake stream after %s and %d bytes", time.Since(s.opened), s.size)
+	c.handleIntakeResponse(ctx, s.endpoint, s.resp, s.pendingCount)
+	switch {
+	case s.resp.StatusCode >= 200 && s.resp.StatusCode < 300:
+		c.recordForwarded(s.pendingCount)
+	case !c.isEndpointDelivered(s.endpoint):
+		c.spillStream(s)
+	}
+	return nil
+}
+
+// spillStream spills the data written to a stream that failed.
+func (c *Client) spillStream(s *intakeStream) {
+	for _, data := range s.pending {
+		c.spillData(data)
+	}
+	s.pending = nil
+}
@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"io"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/logsapi"
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// SelfTelemetrySource is the value of the source label of the metricsets
+// describing the extension itself.
+const SelfTelemetrySource = "apm-aws-lambda"
+
+// Reasons for the extension dropping events before sending them.
+const (
+	DroppedBatchFull           = "batch_full"
+	DroppedMetadataUnavailable = "metadata_unavailable"
+)
+
+// telemetry holds the counters of the extension accumulated since the
+// last self-telemetry report.
+type telemetry struct {
+	eventsReceived  int
+	eventsForwarded int
+	eventsRejected  int
+	bytesSent       int64
+	requests        int
+	requestDuration time.Duration
+	requestMax      time.Duration
+	flushTimeouts   int
+	// transitions holds the number of transitions of the transport
+	// status, keyed by the new status.
+	transitions map[Status]int
+	dropped     map[string]int
+
+	// The Logs API drops are reported as cumulative counts.
+	reportedLogsDroppedRecords int64
+	reportedLogsDroppedBytes   int64
+}
+
+func (t *telemetry) reset() {
+	*t = telemetry{
+		reportedLogsDroppedRecords: t.reportedLogsDroppedRecords,
+		reportedLogsDroppedBytes:   t.reportedLogsDroppedBytes,
+	}
+}
+
+// RecordFlushTimeout records that the wait for the agent or the Logs API
+// to signal the end of an invocation timed out.
+func (c *Client) RecordFlushTimeout() {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.telemetry.flushTimeouts++
+}
+
+func (c *Client) recordReceived(n int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.telemetry.eventsReceived += n
+}
+
+func (c *Client) recordForwarded(n int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.telemetry.eventsForwarded += n
+}
+
+func (c *Client) recordBytesSent(n int64) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.telemetry.bytesSent += n
+}
+
+func (c *Client) recordRequest(d time.Duration) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.telemetry.requests++
+	c.telemetry.requestDuration += d
+	if d > c.telemetry.requestMax {
+		c.telemetry.requestMax = d
+	}
+}
+
+func (c *Client) recordTransition(status Status) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.telemetry.transitions == nil {
+		c.telemetry.transitions = make(map[Status]int)
+	}
+	c.telemetry.transitions[status]++
+}
+
+// addTelemetryMetrics adds a metricset describing the extension itself
+// since the last report to the batch. It does nothing unless enabled
+// with WithSelfTelemetry.
+func (c *Client) addTelemetryMetrics() {
+	if !c.selfTelemetry || c.batch == nil {
+		return
+	}
+
+	var logsDroppedRecords, logsDroppedBytes int64
+	if c.logsAPIDropped != nil {
+		logsDroppedRecords, logsDroppedBytes = c.logsAPIDropped()
+	}
+	faas := c.currentFAAS()
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	t := &c.telemetry
+
+	mc := logsapi.MetricsContainer{
+		Metrics: &model.Metrics{
+			Timestamp: model.Time(time.Now()),
+			Labels:    model.StringMap{{Key: "source", Value: SelfTelemetrySource}},
+		},
+	}
+	if faas.ID != "" {
+		mc.Metrics.FAAS = &model.FAAS{ID: faas.ID, Execution: faas.Execution}
+	}
+	mc.Add("extension.events.received", float64(t.eventsReceived))
+	mc.Add("extension.events.forwarded", float64(t.eventsForwarded))
+	mc.Add("extension.events.rejected", float64(t.eventsRejected))
+	mc.Add("extension.apm_server.bytes_sent", float64(t.bytesSent))
+	mc.Add("extension.apm_server.request.count", float64(t.requests))
+	mc.Add("extension.apm_server.request.duration.sum.us", float64(t.requestDuration.Microseconds()))
+	mc.Add("extension.apm_server.request.duration.max.us", float64(t.requestMax.Microseconds()))
+	mc.Add("extension.flush.timeouts", float64(t.flushTimeouts))
+	mc.Add("extension.logs_api.dropped.records", float64(logsDroppedRecords-t.reportedLogsDroppedRecords))
+	mc.Add("extension.logs_api.dropped.bytes", float64(logsDroppedBytes-t.reportedLogsDroppedBytes))
+	for status, n := range t.transitions {
+		mc.Add("extension.transport.transitions."+string(status), float64(n))
+	}
+	for reason, n := range t.dropped {
+		mc.Add("extension.events.dropped."+reason, float64(n))
+	}
+
+	var w fastjson.Writer
+	if err := mc.MarshalFastJSON(&w); err != nil {
+		c.logger.Warnf("Failed to marshal self-telemetry metrics: %v", err)
+		return
+	}
+	if err := c.batch.AddLambdaData(w.Bytes()); err != nil {
+		c.logger.Debugf("Failed to add self-telemetry metrics to batch: %v", err)
+		return
+	}
+	t.reset()
+	t.reportedLogsDroppedRecords = logsDroppedRecords
+	t.reportedLogsDroppedBytes = logsDroppedBytes
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// tlsOptions holds the TLS settings of the connections to the APM Server.
+type tlsOptions struct {
+	caCert             []byte
+	clientCert         []byte
+	clientKey          []byte
+	fingerprint        string
+	insecureSkipVerify bool
+}
+
+func (c *Client) tlsOptions() *tlsOptions {
+	if c.tls == nil {
+		c.tls = &tlsOptions{}
+	}
+	return c.tls
+}
+
+// config builds the TLS configuration of the connections to the APM
+// Server. The CA bundle is trusted in addition to the system roots.
+func (o *tlsOptions) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.insecureSkipVerify,
+	}
+
+	if len(o.caCert) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(o.caCert) {
+			return nil, errors.New("no valid certificate found in the CA bundle")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(o.clientCert) > 0 || len(o.clientKey) > 0 {
+		cert, err := tls.X509KeyPair(o.clientCert, o.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.fingerprint != "" {
+		pinned, err := parseFingerprint(o.fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyFingerprint(cs.PeerCertificates, pinned)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parseFingerprint decodes a hex encoded SHA-256 fingerprint, optionally
+// separated by colons as printed by openssl.
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint: %s", fingerprint)
+	}
+	return b, nil
+}
+
+// verifyFingerprint checks that a certificate of the chain presented by
+// the APM Server matches the pinned fingerprint, which may be the one of
+// the server certificate or of a CA.
+func verifyFingerprint(certs []*x509.Certificate, pinned []byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		if bytes.Equal(sum[:], pinned) {
+			return nil
+		}
+	}
+	return errors.New("no APM Server certificate matches the pinned fingerprint")
+}
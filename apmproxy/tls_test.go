@@ -0,0 +1,223 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/accumulator"
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTLSServer(t *testing.T) *httptest.Server {
+	apmServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+	return apmServer
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func postTLS(t *testing.T, serverURL string, opts ...apmproxy.Option) (*apmproxy.Client, error) {
+	apmClient, err := apmproxy.NewClient(append([]apmproxy.Option{
+		apmproxy.WithURL(serverURL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, apmClient.Shutdown())
+	})
+	return apmClient, apmClient.PostToApmServer(context.Background(), accumulator.APMData{Data: []byte(`{"metadata":{}}`)})
+}
+
+func TestServerCACert(t *testing.T) {
+	apmServer := newTLSServer(t)
+
+	apmClient, err := postTLS(t, apmServer.URL)
+	assert.Error(t, err)
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+
+	apmClient, err = postTLS(t, apmServer.URL, apmproxy.WithServerCACert(certPEM(apmServer.Certificate())))
+	require.NoError(t, err)
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+}
+
+func TestInvalidServerCACert(t *testing.T) {
+	_, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithServerCACert([]byte("not a certificate")),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	assert.Error(t, err)
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	apmServer := newTLSServer(t)
+
+	apmClient, err := postTLS(t, apmServer.URL, apmproxy.WithInsecureSkipVerify(true))
+	require.NoError(t, err)
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+}
+
+func TestServerCertFingerprint(t *testing.T) {
+	apmServer := newTLSServer(t)
+	sum := sha256.Sum256(apmServer.Certificate().Raw)
+
+	testCases := map[string]struct {
+		fingerprint string
+		expectErr   bool
+	}{
+		"match": {
+			fingerprint: hex.EncodeToString(sum[:]),
+		},
+		"match with colons": {
+			fingerprint: strings.ToUpper(colonSeparated(sum[:])),
+		},
+		"mismatch": {
+			fingerprint: strings.Repeat("00", sha256.Size),
+			expectErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmClient, err := postTLS(t, apmServer.URL,
+				apmproxy.WithServerCACert(certPEM(apmServer.Certificate())),
+				apmproxy.WithServerCertFingerprint(tc.fingerprint),
+			)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, apmproxy.Failing, apmClient.Status)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+			}
+		})
+	}
+
+	_, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithServerCertFingerprint("abcd"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	assert.Error(t, err)
+}
+
+func colonSeparated(b []byte) string {
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = hex.EncodeToString(b[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
+
+func TestClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apm-aws-lambda"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	clientCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	apmServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Len(t, r.TLS.PeerCertificates, 1)
+		assert.Equal(t, "apm-aws-lambda", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	apmServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	apmServer.StartTLS()
+	t.Cleanup(apmServer.Close)
+	caCert := apmproxy.WithServerCACert(certPEM(apmServer.Certificate()))
+
+	_, err = postTLS(t, apmServer.URL, caCert)
+	assert.Error(t, err)
+
+	apmClient, err := postTLS(t, apmServer.URL, caCert, apmproxy.WithClientCertificate(certPEM(clientCert), keyPEM))
+	require.NoError(t, err)
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+	_, err = apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithClientCertificate(certPEM(clientCert), nil),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	assert.Error(t, err)
+}
+
+func TestInfoProxyTLS(t *testing.T) {
+	apmServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`{"version":"8.5.0"}`))
+		require.NoError(t, err)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1250"),
+		apmproxy.WithServerCACert(certPEM(apmServer.Certificate())),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	resp, err := http.Get("http://localhost:1250")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -18,8 +18,11 @@
 package app
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -35,11 +38,6 @@ import (
 	"go.uber.org/zap"
 )
 
-var (
-	defaultMaxBatchSize int           = 50
-	defaultMaxBatchAge  time.Duration = 2 * time.Second
-)
-
 // App is the main application.
 type App struct {
 	extensionName   string
@@ -59,13 +57,77 @@ func New(ctx context.Context, opts ...ConfigOption) (*App, error) {
 		opt(&c)
 	}
 
+	streamIntake, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_STREAM_INTAKE"))
+
+	otlpOutput := false
+	switch output := strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_OUTPUT")); output {
+	case "", "intake":
+	case "otlp":
+		otlpOutput = true
+	default:
+		return nil, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_OUTPUT: %s", output)
+	}
+
+	// Compress the data as it is added to the batch to avoid compressing
+	// the whole batch on the flush path. The intake stream writes events
+	// as they arrive and compresses them on its own and the OTLP output
+	// converts the events before compressing them.
+	var batchOpts []accumulator.BatchOption
+	if !streamIntake && !otlpOutput {
+		batchOpts = append(batchOpts, accumulator.WithCompression(gzip.BestSpeed))
+	}
+
+	maxBatchSize, maxBatchAge, limitOpts, err := loadBatchLimits()
+	if err != nil {
+		return nil, err
+	}
+	batchOpts = append(batchOpts, limitOpts...)
+
+	spanRules, ok, err := loadSpanRules()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		batchOpts = append(batchOpts, accumulator.WithSpanRules(spanRules))
+	}
+
+	compression, ok, err := loadSpanCompression()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		batchOpts = append(batchOpts, accumulator.WithSpanCompression(compression))
+	}
+
+	txnMetrics, ok, err := loadTransactionMetrics()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		batchOpts = append(batchOpts, accumulator.WithTransactionMetrics(txnMetrics))
+	}
+
+	overrides, ok, err := loadMetadataOverrides()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		batchOpts = append(batchOpts, accumulator.WithMetadataOverrides(overrides))
+	}
+
+	redactor, err := loadRedactor()
+	if err != nil {
+		return nil, err
+	}
+	if redactor != nil {
+		batchOpts = append(batchOpts, accumulator.WithRedactor(redactor))
+	}
+
 	app := &App{
 		extensionName: c.extensionName,
-		batch:         accumulator.NewBatch(defaultMaxBatchSize, defaultMaxBatchAge),
+		batch:         accumulator.NewBatch(maxBatchSize, maxBatchAge, batchOpts...),
 	}
 
-	var err error
-
 	if app.logger, err = buildLogger(c.logLevel); err != nil {
 		return nil, err
 	}
@@ -88,14 +150,19 @@ func New(ctx context.Context, opts ...ConfigOption) (*App, error) {
 			subscriptionLogStreams = append(subscriptionLogStreams, logsapi.Function)
 		}
 
-		lc, err := logsapi.NewClient(
+		logsOpts := []logsapi.ClientOption{
 			logsapi.WithLogsAPIBaseURL(fmt.Sprintf("http://%s", c.awsLambdaRuntimeAPI)),
 			logsapi.WithListenerAddress(addr),
 			logsapi.WithLogBuffer(100),
 			logsapi.WithLogger(app.logger),
 			logsapi.WithSubscriptionTypes(subscriptionLogStreams...),
 			logsapi.WithInvocationLifecycler(app.batch),
-		)
+		}
+		if redactor != nil {
+			logsOpts = append(logsOpts, logsapi.WithRedactor(redactor))
+		}
+
+		lc, err := logsapi.NewClient(logsOpts...)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +172,13 @@ func New(ctx context.Context, opts ...ConfigOption) (*App, error) {
 
 	var apmOpts []apmproxy.Option
 
+	if app.logsClient != nil {
+		apmOpts = append(apmOpts,
+			apmproxy.WithLogsAPIState(app.logsClient.SubscriptionState),
+			apmproxy.WithLogsAPIDropped(app.logsClient.LogsDropped),
+		)
+	}
+
 	if receiverTimeout, ok, err := parseDurationTimeout(app.logger, "ELASTIC_APM_DATA_RECEIVER_TIMEOUT", "ELASTIC_APM_DATA_RECEIVER_TIMEOUT_SECONDS"); err != nil || ok {
 		if err != nil {
 			return nil, err
@@ -123,6 +197,68 @@ func New(ctx context.Context, opts ...ConfigOption) (*App, error) {
 		apmOpts = append(apmOpts, apmproxy.WithReceiverAddress(fmt.Sprintf(":%s", port)))
 	}
 
+	if socket := os.Getenv("ELASTIC_APM_DATA_RECEIVER_SOCKET"); socket != "" {
+		apmOpts = append(apmOpts, apmproxy.WithReceiverSocket(socket))
+	}
+
+	if loopbackOnly, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_DATA_RECEIVER_LOOPBACK_ONLY")); loopbackOnly {
+		apmOpts = append(apmOpts, apmproxy.WithReceiverLoopbackOnly(true))
+	}
+
+	// Agents are expected to be configured with the same credentials as
+	// the extension.
+	if receiverAuth, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_DATA_RECEIVER_AUTH")); receiverAuth {
+		apmOpts = append(apmOpts, apmproxy.WithReceiverAuth(apmServerSecretToken, apmServerAPIKey))
+	}
+
+	if maxBodySize := os.Getenv("ELASTIC_APM_DATA_RECEIVER_MAX_BODY_SIZE"); maxBodySize != "" {
+		size, err := strconv.ParseInt(maxBodySize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_DATA_RECEIVER_MAX_BODY_SIZE: %w", err)
+		}
+
+		apmOpts = append(apmOpts, apmproxy.WithReceiverMaxBodySize(size))
+	}
+
+	if maxEventSize := os.Getenv("ELASTIC_APM_DATA_RECEIVER_MAX_EVENT_SIZE"); maxEventSize != "" {
+		size, err := strconv.Atoi(maxEventSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_DATA_RECEIVER_MAX_EVENT_SIZE: %w", err)
+		}
+
+		apmOpts = append(apmOpts, apmproxy.WithReceiverMaxEventSize(size))
+	}
+
+	if policy := os.Getenv("ELASTIC_APM_LAMBDA_BACKPRESSURE_POLICY"); policy != "" {
+		backpressurePolicy, ok := parseBackpressurePolicy(policy)
+		if !ok {
+			return nil, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_BACKPRESSURE_POLICY: %s", policy)
+		}
+		apmOpts = append(apmOpts, apmproxy.WithBackpressurePolicy(backpressurePolicy))
+	}
+
+	if timeout, ok, err := parseDuration("ELASTIC_APM_LAMBDA_BACKPRESSURE_TIMEOUT"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		apmOpts = append(apmOpts, apmproxy.WithBackpressureTimeout(timeout))
+	}
+
+	if ttl, ok, err := parseDuration("ELASTIC_APM_LAMBDA_INFO_CACHE_TTL"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		apmOpts = append(apmOpts, apmproxy.WithInfoCacheTTL(ttl))
+	}
+
+	if prefetch, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_INFO_PREFETCH")); prefetch {
+		apmOpts = append(apmOpts, apmproxy.WithInfoPrefetch(true))
+	}
+
+	if selfTelemetry, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_SELF_TELEMETRY")); selfTelemetry {
+		apmOpts = append(apmOpts, apmproxy.WithSelfTelemetry(true))
+	}
+
 	if strategy, ok := parseStrategy(os.Getenv("ELASTIC_APM_SEND_STRATEGY")); ok {
 		apmOpts = append(apmOpts, apmproxy.WithSendStrategy(strategy))
 	}
@@ -136,8 +272,95 @@ func New(ctx context.Context, opts ...ConfigOption) (*App, error) {
 		apmOpts = append(apmOpts, apmproxy.WithAgentDataBufferSize(size))
 	}
 
+	if maxAttempts := os.Getenv("ELASTIC_APM_LAMBDA_RETRY_MAX_ATTEMPTS"); maxAttempts != "" {
+		attempts, err := strconv.Atoi(maxAttempts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_RETRY_MAX_ATTEMPTS: %w", err)
+		}
+
+		apmOpts = append(apmOpts, apmproxy.WithRetryMaxAttempts(attempts))
+	}
+
+	if backoff, ok, err := parseDuration("ELASTIC_APM_LAMBDA_RETRY_BACKOFF"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		apmOpts = append(apmOpts, apmproxy.WithRetryBackoff(backoff))
+	}
+
+	if maxBackoff, ok, err := parseDuration("ELASTIC_APM_LAMBDA_RETRY_MAX_BACKOFF"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		apmOpts = append(apmOpts, apmproxy.WithRetryMaxBackoff(maxBackoff))
+	}
+
+	if streamIntake {
+		var maxSize int
+		if streamMaxSize := os.Getenv("ELASTIC_APM_LAMBDA_STREAM_MAX_SIZE"); streamMaxSize != "" {
+			if maxSize, err = strconv.Atoi(streamMaxSize); err != nil {
+				return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_STREAM_MAX_SIZE: %w", err)
+			}
+		}
+
+		maxAge, _, err := parseDuration("ELASTIC_APM_LAMBDA_STREAM_MAX_AGE")
+		if err != nil {
+			return nil, err
+		}
+
+		apmOpts = append(apmOpts, apmproxy.WithIntakeStream(maxSize, maxAge))
+	}
+
+	if spillSize := os.Getenv("ELASTIC_APM_LAMBDA_SPILL_QUEUE_SIZE"); spillSize != "" {
+		size, err := strconv.ParseInt(spillSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_SPILL_QUEUE_SIZE: %w", err)
+		}
+
+		apmOpts = append(apmOpts, apmproxy.WithSpillQueue(os.Getenv("ELASTIC_APM_LAMBDA_SPILL_QUEUE_DIR"), size))
+	}
+
+	if mode := os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER_MODE"); mode != "" {
+		endpointMode, ok := parseEndpointMode(mode)
+		if !ok {
+			return nil, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_APM_SERVER_MODE: %s", mode)
+		}
+		apmOpts = append(apmOpts, apmproxy.WithEndpointMode(endpointMode))
+	}
+
+	headers, err := loadServerHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		apmOpts = append(apmOpts, apmproxy.WithHeaders(headers))
+	}
+
+	tlsOpts, err := loadTLSOptions(ctx, c.awsConfig, app.logger)
+	if err != nil {
+		return nil, err
+	}
+	apmOpts = append(apmOpts, tlsOpts...)
+
+	// Managed runtimes are reported as e.g. AWS_Lambda_nodejs18.x.
+	if runtime := strings.TrimPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda_"); runtime != "" {
+		apmOpts = append(apmOpts, apmproxy.WithFunctionRuntime(runtime))
+	}
+
+	serverURLs := parseServerURLs(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER"))
+	if otlpOutput {
+		// The OTEL_EXPORTER_OTLP_* variables are not used as they are
+		// meant for the SDKs running in the function.
+		headers, err := parseKeyValues(os.Getenv("ELASTIC_APM_LAMBDA_OTLP_HEADERS"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_OTLP_HEADERS: %w", err)
+		}
+		serverURLs = parseServerURLs(os.Getenv("ELASTIC_APM_LAMBDA_OTLP_ENDPOINT"))
+		apmOpts = append(apmOpts, apmproxy.WithOTLPOutput(headers, strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_OTLP_COMPRESSION"))))
+	}
+
 	apmOpts = append(apmOpts,
-		apmproxy.WithURL(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER")),
+		apmproxy.WithURLs(serverURLs...),
 		apmproxy.WithLogger(app.logger),
 		apmproxy.WithAPIKey(apmServerAPIKey),
 		apmproxy.WithSecretToken(apmServerSecretToken),
@@ -179,6 +402,20 @@ func parseDurationTimeout(l *zap.SugaredLogger, flag string, deprecatedFlag stri
 	return 0, false, nil
 }
 
+func parseDuration(flag string) (time.Duration, bool, error) {
+	strValue, ok := os.LookupEnv(flag)
+	if !ok {
+		return 0, false, nil
+	}
+
+	d, err := time.ParseDuration(strValue)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse %s: %w", flag, err)
+	}
+
+	return d, true, nil
+}
+
 func parseStrategy(value string) (apmproxy.SendStrategy, bool) {
 	switch strings.ToLower(value) {
 	case "background":
@@ -190,6 +427,274 @@ func parseStrategy(value string) (apmproxy.SendStrategy, bool) {
 	return "", false
 }
 
+func parseBackpressurePolicy(value string) (apmproxy.BackpressurePolicy, bool) {
+	switch strings.ToLower(value) {
+	case "drop_newest":
+		return apmproxy.DropNewest, true
+	case "drop_oldest":
+		return apmproxy.DropOldest, true
+	case "block":
+		return apmproxy.Block, true
+	case "reject":
+		return apmproxy.Reject, true
+	}
+
+	return "", false
+}
+
+func parseEndpointMode(value string) (apmproxy.EndpointMode, bool) {
+	switch strings.ToLower(value) {
+	case "failover":
+		return apmproxy.Failover, true
+	case "fanout":
+		return apmproxy.Fanout, true
+	}
+
+	return "", false
+}
+
+// parseServerURLs splits a comma separated list of APM Server URLs.
+func parseServerURLs(value string) []string {
+	var urls []string
+	for _, u := range strings.Split(value, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
+// loadBatchLimits loads the limits of the batch. Zero values, and the
+// options not returned, fall back to the defaults of the batch.
+func loadBatchLimits() (int, time.Duration, []accumulator.BatchOption, error) {
+	var (
+		maxSize int
+		opts    []accumulator.BatchOption
+	)
+	if size := os.Getenv("ELASTIC_APM_LAMBDA_BATCH_MAX_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_BATCH_MAX_SIZE: %w", err)
+		}
+		maxSize = n
+	}
+	maxAge, _, err := parseDuration("ELASTIC_APM_LAMBDA_BATCH_MAX_AGE")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if size := os.Getenv("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES: %w", err)
+		}
+		opts = append(opts, accumulator.WithMaxBytes(n))
+	}
+
+	maxEventBytes := accumulator.DefaultMaxEventBytes
+	if size := os.Getenv("ELASTIC_APM_LAMBDA_BATCH_MAX_EVENT_BYTES"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_BATCH_MAX_EVENT_BYTES: %w", err)
+		}
+		maxEventBytes = n
+	}
+	policy := accumulator.TruncateOversized
+	switch value := strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_BATCH_OVERSIZED_EVENTS")); value {
+	case "", "truncate":
+	case "drop":
+		policy = accumulator.DropOversized
+	default:
+		return 0, 0, nil, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_BATCH_OVERSIZED_EVENTS: %s", value)
+	}
+	opts = append(opts, accumulator.WithMaxEventBytes(maxEventBytes, policy))
+
+	return maxSize, maxAge, opts, nil
+}
+
+// loadSpanRules loads the rules applied to the agent events, returning
+// false if none is configured.
+func loadSpanRules() (accumulator.SpanRules, bool, error) {
+	var rules accumulator.SpanRules
+	minDuration, ok, err := parseDuration("ELASTIC_APM_LAMBDA_SPAN_MIN_DURATION")
+	if err != nil {
+		return rules, false, err
+	}
+	configured := ok
+	rules.MinDuration = minDuration
+
+	if names := os.Getenv("ELASTIC_APM_LAMBDA_SPAN_DROP_NAMES"); names != "" {
+		rules.DropNames = strings.Split(names, ",")
+		configured = true
+	}
+	if types := os.Getenv("ELASTIC_APM_LAMBDA_SPAN_DROP_TYPES"); types != "" {
+		rules.DropTypes = strings.Split(types, ",")
+		configured = true
+	}
+	if strip, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_STRIP_STACKTRACES")); strip {
+		rules.StripStacktraces = true
+		configured = true
+	}
+	if maxLength := os.Getenv("ELASTIC_APM_LAMBDA_MAX_STRING_LENGTH"); maxLength != "" {
+		n, err := strconv.Atoi(maxLength)
+		if err != nil {
+			return rules, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_MAX_STRING_LENGTH: %w", err)
+		}
+		rules.MaxStringLength = n
+		configured = true
+	}
+
+	return rules, configured, nil
+}
+
+// loadSpanCompression loads the compression of the agent spans, returning
+// false if it is not enabled.
+func loadSpanCompression() (accumulator.SpanCompression, bool, error) {
+	cfg := accumulator.SpanCompression{
+		ExactMatchMaxDuration: accumulator.DefaultExactMatchMaxDuration,
+	}
+	if enabled, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_SPAN_COMPRESSION_ENABLED")); !enabled {
+		return cfg, false, nil
+	}
+	if d, ok, err := parseDuration("ELASTIC_APM_LAMBDA_SPAN_COMPRESSION_EXACT_MATCH_MAX_DURATION"); err != nil || ok {
+		if err != nil {
+			return cfg, false, err
+		}
+		cfg.ExactMatchMaxDuration = d
+	}
+	if d, ok, err := parseDuration("ELASTIC_APM_LAMBDA_SPAN_COMPRESSION_SAME_KIND_MAX_DURATION"); err != nil || ok {
+		if err != nil {
+			return cfg, false, err
+		}
+		cfg.SameKindMaxDuration = d
+	}
+	return cfg, true, nil
+}
+
+// loadTransactionMetrics loads the aggregation of the agent transactions,
+// returning false if it is not enabled.
+func loadTransactionMetrics() (accumulator.TransactionMetrics, bool, error) {
+	var cfg accumulator.TransactionMetrics
+	if enabled, _ := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_TRANSACTION_METRICS")); !enabled {
+		return cfg, false, nil
+	}
+	interval, _, err := parseDuration("ELASTIC_APM_LAMBDA_TRANSACTION_METRICS_INTERVAL")
+	if err != nil {
+		return cfg, false, err
+	}
+	cfg.Interval = interval
+	cfg.DropUnsampled, _ = strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_DROP_UNSAMPLED_TRANSACTIONS"))
+	return cfg, true, nil
+}
+
+// loadMetadataOverrides loads the overrides of the agent metadata,
+// returning false if none is configured.
+func loadMetadataOverrides() (accumulator.MetadataOverrides, bool, error) {
+	overrides := accumulator.MetadataOverrides{
+		ServiceName:        os.Getenv("ELASTIC_APM_LAMBDA_SERVICE_NAME"),
+		ServiceEnvironment: os.Getenv("ELASTIC_APM_LAMBDA_SERVICE_ENVIRONMENT"),
+		ServiceVersion:     os.Getenv("ELASTIC_APM_LAMBDA_SERVICE_VERSION"),
+	}
+
+	var err error
+	if overrides.GlobalLabels, err = parseKeyValues(os.Getenv("ELASTIC_APM_LAMBDA_GLOBAL_LABELS")); err != nil {
+		return overrides, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_GLOBAL_LABELS: %w", err)
+	}
+	// e.g. account.name=prod,availability_zone=eu-west-1a
+	if overrides.Cloud, err = parseKeyValues(os.Getenv("ELASTIC_APM_LAMBDA_CLOUD_METADATA")); err != nil {
+		return overrides, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_CLOUD_METADATA: %w", err)
+	}
+
+	ok := overrides.ServiceName != "" || overrides.ServiceEnvironment != "" || overrides.ServiceVersion != "" ||
+		len(overrides.GlobalLabels) > 0 || len(overrides.Cloud) > 0
+	return overrides, ok, nil
+}
+
+// redactionPatterns are the predefined patterns of values that can be
+// masked with ELASTIC_APM_LAMBDA_REDACT_VALUES.
+var redactionPatterns = map[string]string{
+	"card_number":    `\b(?:\d[ -]?){12,18}\d\b`,
+	"email":          `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"aws_access_key": `\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`,
+}
+
+// loadRedactor loads the redaction rules, returning nil if none is
+// configured. Values are masked if they match one of the predefined
+// patterns listed in ELASTIC_APM_LAMBDA_REDACT_VALUES or the regular
+// expression in ELASTIC_APM_LAMBDA_REDACT_VALUE_PATTERN.
+func loadRedactor() (*accumulator.Redactor, error) {
+	var rules accumulator.RedactionRules
+	if names := os.Getenv("ELASTIC_APM_LAMBDA_REDACT_FIELD_NAMES"); names != "" {
+		rules.FieldNames = strings.Split(names, ",")
+	}
+	for _, name := range strings.Split(os.Getenv("ELASTIC_APM_LAMBDA_REDACT_VALUES"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		pattern, ok := redactionPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_REDACT_VALUES: unknown pattern %s", name)
+		}
+		rules.ValuePatterns = append(rules.ValuePatterns, pattern)
+	}
+	if pattern := os.Getenv("ELASTIC_APM_LAMBDA_REDACT_VALUE_PATTERN"); pattern != "" {
+		rules.ValuePatterns = append(rules.ValuePatterns, pattern)
+	}
+	if len(rules.FieldNames) == 0 && len(rules.ValuePatterns) == 0 {
+		return nil, nil
+	}
+	return accumulator.NewRedactor(rules)
+}
+
+// loadServerHeaders loads the headers of the requests to the APM Server
+// from the JSON object in ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS_FILE, if
+// set, and from ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS which takes
+// precedence.
+func loadServerHeaders() (map[string]string, error) {
+	headers := make(map[string]string)
+	if path := os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS_FILE: %w", err)
+		}
+		if err := json.Unmarshal(b, &headers); err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS_FILE: %w", err)
+		}
+	}
+
+	envHeaders, err := parseKeyValues(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_APM_SERVER_HEADERS: %w", err)
+	}
+	for k, v := range envHeaders {
+		headers[k] = v
+	}
+
+	return headers, nil
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs, with
+// URL encoded values, as in OTEL_EXPORTER_OTLP_HEADERS.
+func parseKeyValues(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %s", pair)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", k, err)
+		}
+		pairs[strings.TrimSpace(k)] = v
+	}
+
+	return pairs, nil
+}
+
 func buildLogger(level string) (*zap.SugaredLogger, error) {
 	if level == "" {
 		level = "info"
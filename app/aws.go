@@ -22,9 +22,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/elastic/apm-aws-lambda/apmproxy"
 	"go.uber.org/zap"
 )
 
@@ -56,6 +58,74 @@ func loadAWSOptions(ctx context.Context, cfg aws.Config, logger *zap.SugaredLogg
 	return apmServerApiKey, apmServerSecretToken, nil
 }
 
+// loadTLSOptions loads the TLS settings of the connections to the APM
+// Server. The PEM encoded CA bundle, client certificate and client key are
+// read from files, e.g. shipped in a layer, or from Secrets Manager.
+func loadTLSOptions(ctx context.Context, cfg aws.Config, logger *zap.SugaredLogger) ([]apmproxy.Option, error) {
+	manager := secretsmanager.NewFromConfig(cfg)
+
+	var opts []apmproxy.Option
+
+	caCert, err := loadPEM(ctx, manager, "ELASTIC_APM_LAMBDA_SERVER_CA_CERT_FILE", "ELASTIC_APM_SECRETS_MANAGER_SERVER_CA_CERT_ID")
+	if err != nil {
+		return nil, err
+	}
+	if caCert != nil {
+		opts = append(opts, apmproxy.WithServerCACert(caCert))
+	}
+
+	clientCert, err := loadPEM(ctx, manager, "ELASTIC_APM_LAMBDA_CLIENT_CERT_FILE", "ELASTIC_APM_SECRETS_MANAGER_CLIENT_CERT_ID")
+	if err != nil {
+		return nil, err
+	}
+	clientKey, err := loadPEM(ctx, manager, "ELASTIC_APM_LAMBDA_CLIENT_KEY_FILE", "ELASTIC_APM_SECRETS_MANAGER_CLIENT_KEY_ID")
+	if err != nil {
+		return nil, err
+	}
+	if clientCert != nil || clientKey != nil {
+		opts = append(opts, apmproxy.WithClientCertificate(clientCert, clientKey))
+	}
+
+	if fingerprint := os.Getenv("ELASTIC_APM_LAMBDA_SERVER_CERT_FINGERPRINT"); fingerprint != "" {
+		opts = append(opts, apmproxy.WithServerCertFingerprint(fingerprint))
+	}
+
+	if value := os.Getenv("ELASTIC_APM_LAMBDA_VERIFY_SERVER_CERT"); value != "" {
+		verify, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_VERIFY_SERVER_CERT: %w", err)
+		}
+		if !verify {
+			logger.Warn("Verification of the APM Server certificate is disabled. This must only be used for testing.")
+			opts = append(opts, apmproxy.WithInsecureSkipVerify(true))
+		}
+	}
+
+	return opts, nil
+}
+
+// loadPEM reads PEM encoded data from the file set in fileEnv or, if
+// set, from the secret whose ID is set in secretEnv.
+func loadPEM(ctx context.Context, manager *secretsmanager.Client, fileEnv, secretEnv string) ([]byte, error) {
+	if secretID, ok := os.LookupEnv(secretEnv); ok {
+		result, err := loadSecret(ctx, manager, secretID)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading %s from Secrets Manager: %w", secretEnv, err)
+		}
+		return []byte(result), nil
+	}
+
+	if path := os.Getenv(fileEnv); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", fileEnv, err)
+		}
+		return b, nil
+	}
+
+	return nil, nil
+}
+
 func loadSecret(ctx context.Context, manager *secretsmanager.Client, secretID string) (string, error) {
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId:     ptrFromString(secretID),
@@ -20,9 +20,13 @@ package app
 import (
 	"context"
 	"fmt"
+	"os"
+	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/elastic/apm-aws-lambda/accumulator"
 	"github.com/elastic/apm-aws-lambda/extension"
 )
 
@@ -43,6 +47,7 @@ func (app *App) Run(ctx context.Context) error {
 		return err
 	}
 	app.logger.Debugf("Register response: %v", extension.PrettyPrint(res))
+	app.batch.SetFunctionInfo(functionInfo(res))
 
 	// start http server to receive data from agent
 	err = app.apmClient.StartReceiver()
@@ -55,6 +60,14 @@ func (app *App) Run(ctx context.Context) error {
 		}
 	}()
 
+	// Fetch the APM server info while the function initializes so that
+	// agents don't wait for it.
+	go func() {
+		if err := app.apmClient.PrefetchInfo(ctx); err != nil {
+			app.logger.Warnf("Error while prefetching the APM server info: %v", err)
+		}
+	}()
+
 	// Flush all data before shutting down.
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -105,11 +118,16 @@ func (app *App) Run(ctx context.Context) error {
 				// Use a new cancellable context for flushing APM data to make sure
 				// that the underlying transport is reset for next invocation without
 				// waiting for grace period if it got to unhealthy state.
-				flushCtx, cancel := context.WithCancel(ctx)
+				flushCtx, cancel := context.WithDeadline(ctx, time.UnixMilli(event.DeadlineMs))
 				// Flush APM data now that the function invocation has completed
 				app.apmClient.FlushAPMData(flushCtx)
 				cancel()
 			}
+			// The intake stream, if any, must be completed before the
+			// extension is frozen as the connection would not survive it.
+			if err := app.apmClient.CloseStream(ctx); err != nil {
+				app.logger.Warnf("Error while closing the intake stream: %v", err)
+			}
 			prevEvent = event
 		}
 	}
@@ -123,10 +141,6 @@ func (app *App) processEvent(
 	// Reset flush state for future events.
 	defer app.apmClient.ResetFlush()
 
-	// Invocation context
-	invocationCtx, invocationCancel := context.WithCancel(ctx)
-	defer invocationCancel()
-
 	// call Next method of extension API.  This long polling HTTP method
 	// will block until there's an invocation of the function
 	app.logger.Info("Waiting for next event...")
@@ -149,6 +163,11 @@ func (app *App) processEvent(
 	app.logger.Debug("Received event.")
 	app.logger.Debugf("%v", extension.PrettyPrint(event))
 
+	// Invocation context, bounded by the function deadline so that retries
+	// to APM Server don't outlive the invocation.
+	invocationCtx, invocationCancel := context.WithDeadline(ctx, time.UnixMilli(event.DeadlineMs))
+	defer invocationCancel()
+
 	switch event.EventType {
 	case extension.Invoke:
 		app.batch.RegisterInvocation(
@@ -236,6 +255,29 @@ func (app *App) processEvent(
 		app.logger.Debug("Received runtimeDone signal")
 	case <-timer.C:
 		app.logger.Info("Time expired while waiting for agent done signal or final log event")
+		app.apmClient.RecordFlushTimeout()
 	}
 	return event, nil
 }
+
+// functionInfo describes the function from the register response and the
+// environment of the function.
+func functionInfo(res *extension.RegisterResponse) accumulator.FunctionInfo {
+	// The extension is built for the architecture of the function.
+	arch := runtime.GOARCH
+	if arch == "amd64" {
+		arch = "x86_64"
+	}
+	memorySize, _ := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+	return accumulator.FunctionInfo{
+		Name:             res.FunctionName,
+		Version:          res.FunctionVersion,
+		Region:           os.Getenv("AWS_REGION"),
+		Runtime:          os.Getenv("AWS_EXECUTION_ENV"),
+		Architecture:     arch,
+		MemorySizeMB:     memorySize,
+		LogGroup:         os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"),
+		LogStream:        os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+		ExtensionVersion: extension.Version,
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -43,6 +44,13 @@ const (
 	Extension SubscriptionType = "extension"
 )
 
+// States of the subscription to the Logs API.
+const (
+	SubscriptionPending = "pending"
+	SubscriptionActive  = "subscribed"
+	SubscriptionFailed  = "failed"
+)
+
 // ClientOption is a config option for a Client.
 type ClientOption func(*Client)
 
@@ -50,6 +58,10 @@ type invocationLifecycler interface {
 	OnLambdaLogRuntimeDone(requestID, status string, time time.Time) error
 }
 
+type redactor interface {
+	Redact(data []byte) []byte
+}
+
 // Client is the client used to subscribe to the Logs API.
 type Client struct {
 	httpClient               *http.Client
@@ -60,6 +72,10 @@ type Client struct {
 	server                   *http.Server
 	logger                   *zap.SugaredLogger
 	invocationLifecycler     invocationLifecycler
+	redactor                 redactor
+	subscriptionState        atomic.Value
+	droppedRecords           atomic.Int64
+	droppedBytes             atomic.Int64
 }
 
 // NewClient returns a new Client with the given URL.
@@ -91,6 +107,16 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 
 // StartService starts the HTTP server listening for log events and subscribes to the Logs API.
 func (lc *Client) StartService(extensionID string) error {
+	if err := lc.startService(extensionID); err != nil {
+		lc.subscriptionState.Store(SubscriptionFailed)
+		return err
+	}
+
+	lc.subscriptionState.Store(SubscriptionActive)
+	return nil
+}
+
+func (lc *Client) startService(extensionID string) error {
 	addr, err := lc.startHTTPServer()
 	if err != nil {
 		return err
@@ -124,6 +150,20 @@ func (lc *Client) StartService(extensionID string) error {
 	return nil
 }
 
+// SubscriptionState returns the state of the subscription to the Logs API.
+func (lc *Client) SubscriptionState() string {
+	if state, ok := lc.subscriptionState.Load().(string); ok {
+		return state
+	}
+	return SubscriptionPending
+}
+
+// LogsDropped returns the number of records and bytes dropped by the Logs
+// API, as reported in platform.logsDropped events.
+func (lc *Client) LogsDropped() (records, bytes int64) {
+	return lc.droppedRecords.Load(), lc.droppedBytes.Load()
+}
+
 // Shutdown shutdowns the log service gracefully.
 func (lc *Client) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -51,6 +51,10 @@ type LogEventRecord struct {
 	RequestID string          `json:"requestId"`
 	Status    string          `json:"status"`
 	Metrics   PlatformMetrics `json:"metrics"`
+	// DroppedRecords and DroppedBytes are set for platform.logsDropped
+	// events.
+	DroppedRecords int64 `json:"droppedRecords"`
+	DroppedBytes   int64 `json:"droppedBytes"`
 }
 
 // ProcessLogs consumes log events until there are no more log events that
@@ -120,6 +124,8 @@ func (lc *Client) ProcessLogs(
 				}
 			case PlatformLogsDropped:
 				lc.logger.Warnf("Logs dropped due to extension falling behind: %v", logEvent.Record)
+				lc.droppedRecords.Add(logEvent.Record.DroppedRecords)
+				lc.droppedBytes.Add(logEvent.Record.DroppedBytes)
 			case FunctionLog:
 				processedLog, err := ProcessFunctionLog(
 					platformStartReqID,
@@ -129,6 +135,9 @@ func (lc *Client) ProcessLogs(
 				if err != nil {
 					lc.logger.Warnf("Error processing function log : %v", err)
 				} else {
+					if lc.redactor != nil {
+						processedLog = lc.redactor.Redact(processedLog)
+					}
 					select {
 					case dataChan <- processedLog:
 					case <-ctx.Done():
@@ -65,3 +65,11 @@ func WithInvocationLifecycler(l invocationLifecycler) ClientOption {
 		c.invocationLifecycler = l
 	}
 }
+
+// WithRedactor configures a redactor masking sensitive data in the
+// function logs.
+func WithRedactor(r redactor) ClientOption {
+	return func(c *Client) {
+		c.redactor = r
+	}
+}
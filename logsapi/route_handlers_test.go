@@ -77,6 +77,25 @@ func TestLogEventUnmarshalFault(t *testing.T) {
 
 }
 
+func TestLogEventUnmarshalLogsDropped(t *testing.T) {
+	le := new(LogEvent)
+	droppedJSON := []byte(`{
+		"time": "2020-08-20T12:31:32.123Z",
+		"type": "platform.logsDropped",
+		"record": {
+			"reason": "Consumer seems to have fallen behind as it has not acknowledged receipt of logs.",
+			"droppedRecords": 123,
+			"droppedBytes": 12345
+		}
+	}`)
+
+	err := le.UnmarshalJSON(droppedJSON)
+	require.NoError(t, err)
+	assert.Equal(t, PlatformLogsDropped, le.Type)
+	assert.Equal(t, int64(123), le.Record.DroppedRecords)
+	assert.Equal(t, int64(12345), le.Record.DroppedBytes)
+}
+
 func Test_unmarshalRuntimeDoneRecordObject(t *testing.T) {
 	le := new(LogEvent)
 	jsonBytes := []byte(`
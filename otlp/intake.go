@@ -0,0 +1,413 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// scopeName is the instrumentation scope of the data converted from
+// intake v2 events.
+const scopeName = "github.com/elastic/apm-aws-lambda"
+
+// Data holds the OTLP data converted from intake v2 events. The fields
+// are nil if there is no event of the corresponding signal.
+type Data struct {
+	Traces  *tracev1.TracesData
+	Metrics *metricsv1.MetricsData
+	Logs    *logsv1.LogsData
+}
+
+// FromIntakeV2 converts intake v2 ndjson, the metadata followed by the
+// events, to OTLP data. Transactions and spans become spans, metricsets
+// become metrics, logs become log records and errors become log records
+// with the exception attributes. Invalid and unknown events are skipped.
+func FromIntakeV2(data []byte) (Data, error) {
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	md := gjson.GetBytes(lines[0], "metadata")
+	if !md.IsObject() {
+		return Data{}, errors.New("intake v2 data doesn't start with metadata")
+	}
+	resource := &resourcev1.Resource{Attributes: intakeResourceAttributes(md)}
+	scope := &commonv1.InstrumentationScope{Name: scopeName}
+
+	var (
+		spans   []*tracev1.Span
+		metrics []*metricsv1.Metric
+		records []*logsv1.LogRecord
+	)
+	for _, line := range lines[1:] {
+		if !gjson.ValidBytes(line) {
+			continue
+		}
+		gjson.ParseBytes(line).ForEach(func(key, event gjson.Result) bool {
+			switch key.String() {
+			case "transaction":
+				spans = append(spans, intakeTransaction(event))
+			case "span":
+				spans = append(spans, intakeSpan(event))
+			case "metricset":
+				metrics = append(metrics, intakeMetricset(event)...)
+			case "log":
+				records = append(records, intakeLog(event))
+			case "error":
+				records = append(records, intakeError(event))
+			}
+			// Events have a single key.
+			return false
+		})
+	}
+
+	var d Data
+	if len(spans) > 0 {
+		d.Traces = &tracev1.TracesData{ResourceSpans: []*tracev1.ResourceSpans{{
+			Resource:   resource,
+			ScopeSpans: []*tracev1.ScopeSpans{{Scope: scope, Spans: spans}},
+		}}}
+	}
+	if len(metrics) > 0 {
+		d.Metrics = &metricsv1.MetricsData{ResourceMetrics: []*metricsv1.ResourceMetrics{{
+			Resource:     resource,
+			ScopeMetrics: []*metricsv1.ScopeMetrics{{Scope: scope, Metrics: metrics}},
+		}}}
+	}
+	if len(records) > 0 {
+		d.Logs = &logsv1.LogsData{ResourceLogs: []*logsv1.ResourceLogs{{
+			Resource:  resource,
+			ScopeLogs: []*logsv1.ScopeLogs{{Scope: scope, LogRecords: records}},
+		}}}
+	}
+	return d, nil
+}
+
+// intakeResourceAttributes maps the intake v2 metadata to the resource
+// semantic conventions. Global labels are kept as is.
+func intakeResourceAttributes(md gjson.Result) []*commonv1.KeyValue {
+	var attrs attributes
+	attrs.addString("service.name", md.Get("service.name"))
+	attrs.addString("service.version", md.Get("service.version"))
+	attrs.addString("deployment.environment", md.Get("service.environment"))
+	attrs.addString("service.instance.id", md.Get("service.node.configured_name"))
+	attrs.addString("telemetry.sdk.name", md.Get("service.agent.name"))
+	attrs.addString("telemetry.sdk.version", md.Get("service.agent.version"))
+	attrs.addString("telemetry.sdk.language", md.Get("service.language.name"))
+	attrs.addString("process.runtime.name", md.Get("service.runtime.name"))
+	attrs.addString("process.runtime.version", md.Get("service.runtime.version"))
+	attrs.addString("host.name", md.Get("system.configured_hostname"))
+	attrs.addString("host.arch", md.Get("system.architecture"))
+	attrs.addString("cloud.provider", md.Get("cloud.provider"))
+	attrs.addString("cloud.region", md.Get("cloud.region"))
+	attrs.addString("cloud.availability_zone", md.Get("cloud.availability_zone"))
+	attrs.addString("cloud.account.id", md.Get("cloud.account.id"))
+	attrs.addMap(md.Get("labels"))
+	return attrs
+}
+
+func intakeTransaction(tx gjson.Result) *tracev1.Span {
+	kind := tracev1.Span_SPAN_KIND_SERVER
+	if tx.Get("type").String() == "messaging" {
+		kind = tracev1.Span_SPAN_KIND_CONSUMER
+	}
+	span := newSpan(tx, kind)
+
+	var attrs attributes
+	attrs.addString("transaction.type", tx.Get("type"))
+	attrs.addString("transaction.result", tx.Get("result"))
+	attrs.addString("faas.invocation_id", tx.Get("faas.execution"))
+	attrs.addString("cloud.resource_id", tx.Get("faas.id"))
+	attrs.addString("faas.name", tx.Get("faas.name"))
+	attrs.addString("faas.version", tx.Get("faas.version"))
+	attrs.addString("faas.trigger", tx.Get("faas.trigger.type"))
+	attrs.addValue("faas.coldstart", tx.Get("faas.coldstart"))
+	attrs.addMap(tx.Get("context.tags"))
+	attrs.addMap(tx.Get("otel.attributes"))
+	span.Attributes = attrs
+	return span
+}
+
+func intakeSpan(s gjson.Result) *tracev1.Span {
+	kind := tracev1.Span_SPAN_KIND_INTERNAL
+	switch s.Get("type").String() {
+	case "db", "external", "storage":
+		kind = tracev1.Span_SPAN_KIND_CLIENT
+	case "messaging":
+		kind = tracev1.Span_SPAN_KIND_PRODUCER
+	}
+	span := newSpan(s, kind)
+
+	var attrs attributes
+	attrs.addString("span.type", s.Get("type"))
+	attrs.addString("span.subtype", s.Get("subtype"))
+	attrs.addString("span.action", s.Get("action"))
+	if s.Get("type").String() == "db" {
+		attrs.addString("db.system", s.Get("subtype"))
+	}
+	attrs.addString("db.name", s.Get("context.db.instance"))
+	attrs.addString("db.statement", s.Get("context.db.statement"))
+	attrs.addString("http.url", s.Get("context.http.url"))
+	attrs.addString("http.method", s.Get("context.http.method"))
+	attrs.addValue("http.status_code", s.Get("context.http.status_code"))
+	attrs.addString("peer.service", s.Get("context.destination.service.resource"))
+	attrs.addMap(s.Get("context.tags"))
+	attrs.addMap(s.Get("otel.attributes"))
+	span.Attributes = attrs
+	return span
+}
+
+// newSpan converts the fields shared by transactions and spans.
+func newSpan(event gjson.Result, kind tracev1.Span_SpanKind) *tracev1.Span {
+	start := intakeTimestamp(event.Get("timestamp"))
+	span := &tracev1.Span{
+		TraceId:           hexID(event.Get("trace_id")),
+		SpanId:            hexID(event.Get("id")),
+		ParentSpanId:      hexID(event.Get("parent_id")),
+		Name:              event.Get("name").String(),
+		Kind:              kind,
+		StartTimeUnixNano: start,
+		EndTimeUnixNano:   start + uint64(event.Get("duration").Float()*float64(time.Millisecond)),
+	}
+	switch event.Get("outcome").String() {
+	case "success":
+		span.Status = &tracev1.Status{Code: tracev1.Status_STATUS_CODE_OK}
+	case "failure":
+		span.Status = &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR}
+	}
+	return span
+}
+
+func intakeMetricset(ms gjson.Result) []*metricsv1.Metric {
+	ts := intakeTimestamp(ms.Get("timestamp"))
+
+	var attrs attributes
+	attrs.addMap(ms.Get("tags"))
+	attrs.addString("transaction.name", ms.Get("transaction.name"))
+	attrs.addString("transaction.type", ms.Get("transaction.type"))
+	attrs.addString("span.type", ms.Get("span.type"))
+	attrs.addString("span.subtype", ms.Get("span.subtype"))
+	attrs.addString("faas.invocation_id", ms.Get("faas.execution"))
+	attrs.addString("cloud.resource_id", ms.Get("faas.id"))
+
+	var metrics []*metricsv1.Metric
+	ms.Get("samples").ForEach(func(name, sample gjson.Result) bool {
+		m := &metricsv1.Metric{Name: name.String(), Unit: sample.Get("unit").String()}
+		switch {
+		case sample.Get("counts").IsArray():
+			m.Data = &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+				AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             []*metricsv1.HistogramDataPoint{intakeHistogram(sample, ts, attrs)},
+			}}
+		case sample.Get("type").String() == "counter":
+			m.Data = &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricsv1.NumberDataPoint{numberDataPoint(sample, ts, attrs)},
+			}}
+		default:
+			m.Data = &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{
+				DataPoints: []*metricsv1.NumberDataPoint{numberDataPoint(sample, ts, attrs)},
+			}}
+		}
+		metrics = append(metrics, m)
+		return true
+	})
+	return metrics
+}
+
+func numberDataPoint(sample gjson.Result, ts uint64, attrs []*commonv1.KeyValue) *metricsv1.NumberDataPoint {
+	return &metricsv1.NumberDataPoint{
+		TimeUnixNano: ts,
+		Attributes:   attrs,
+		Value:        &metricsv1.NumberDataPoint_AsDouble{AsDouble: sample.Get("value").Float()},
+	}
+}
+
+// intakeHistogram converts the values and counts of an intake v2
+// histogram to explicit buckets whose upper bounds are the values.
+func intakeHistogram(sample gjson.Result, ts uint64, attrs []*commonv1.KeyValue) *metricsv1.HistogramDataPoint {
+	values := sample.Get("values").Array()
+	counts := sample.Get("counts").Array()
+	dp := &metricsv1.HistogramDataPoint{
+		TimeUnixNano:   ts,
+		Attributes:     attrs,
+		ExplicitBounds: make([]float64, 0, len(values)),
+		BucketCounts:   make([]uint64, 0, len(values)+1),
+	}
+	var sum float64
+	for i, v := range values {
+		if i >= len(counts) {
+			break
+		}
+		count := counts[i].Uint()
+		dp.ExplicitBounds = append(dp.ExplicitBounds, v.Float())
+		dp.BucketCounts = append(dp.BucketCounts, count)
+		dp.Count += count
+		sum += v.Float() * float64(count)
+	}
+	// The overflow bucket is always empty.
+	dp.BucketCounts = append(dp.BucketCounts, 0)
+	dp.Sum = &sum
+	return dp
+}
+
+func intakeLog(l gjson.Result) *logsv1.LogRecord {
+	level := l.Get(`log\.level`).String()
+	record := &logsv1.LogRecord{
+		TimeUnixNano:   intakeTimestamp(l.Get(`@timestamp`)),
+		SeverityText:   level,
+		SeverityNumber: severityNumber(level),
+		Body:           &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: l.Get("message").String()}},
+		TraceId:        hexID(l.Get(`trace\.id`)),
+		SpanId:         hexID(l.Get(`span\.id`)),
+	}
+
+	var attrs attributes
+	attrs.addString("faas.invocation_id", l.Get("faas.execution"))
+	attrs.addString("cloud.resource_id", l.Get("faas.id"))
+	attrs.addMap(l.Get("labels"))
+	record.Attributes = attrs
+	return record
+}
+
+// intakeError converts an error to a log record following the semantic
+// conventions for exceptions.
+func intakeError(e gjson.Result) *logsv1.LogRecord {
+	message := e.Get("exception.message").String()
+	if message == "" {
+		message = e.Get("log.message").String()
+	}
+	record := &logsv1.LogRecord{
+		TimeUnixNano:   intakeTimestamp(e.Get("timestamp")),
+		SeverityText:   "error",
+		SeverityNumber: logsv1.SeverityNumber_SEVERITY_NUMBER_ERROR,
+		Body:           &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: message}},
+		TraceId:        hexID(e.Get("trace_id")),
+		SpanId:         hexID(e.Get("parent_id")),
+	}
+
+	var attrs attributes
+	attrs.add("event.name", "exception")
+	attrs.addString("exception.type", e.Get("exception.type"))
+	attrs.addString("exception.message", e.Get("exception.message"))
+	attrs.addString("error.id", e.Get("id"))
+	attrs.addString("error.culprit", e.Get("culprit"))
+	attrs.addMap(e.Get("context.tags"))
+	record.Attributes = attrs
+	return record
+}
+
+func severityNumber(level string) logsv1.SeverityNumber {
+	switch strings.ToLower(level) {
+	case "trace":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_TRACE
+	case "debug":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case "info":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_INFO
+	case "warn", "warning":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_WARN
+	case "error":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case "fatal", "critical":
+		return logsv1.SeverityNumber_SEVERITY_NUMBER_FATAL
+	}
+	return logsv1.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED
+}
+
+// intakeTimestamp converts a timestamp in microseconds since the epoch
+// to nanoseconds. Events without a timestamp are timestamped now.
+func intakeTimestamp(r gjson.Result) uint64 {
+	if !r.Exists() {
+		return uint64(time.Now().UnixNano())
+	}
+	return uint64(r.Int()) * uint64(time.Microsecond)
+}
+
+func hexID(r gjson.Result) []byte {
+	id, err := hex.DecodeString(r.String())
+	if err != nil || len(id) == 0 {
+		return nil
+	}
+	return id
+}
+
+// attributes builds the attributes of OTLP data from intake v2 fields,
+// skipping the missing ones.
+type attributes []*commonv1.KeyValue
+
+func (a *attributes) add(key, s string) {
+	if s != "" {
+		*a = append(*a, &commonv1.KeyValue{Key: key, Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: s}}})
+	}
+}
+
+func (a *attributes) addString(key string, r gjson.Result) {
+	a.add(key, r.String())
+}
+
+func (a *attributes) addValue(key string, r gjson.Result) {
+	if v := resultValue(r); v != nil {
+		*a = append(*a, &commonv1.KeyValue{Key: key, Value: v})
+	}
+}
+
+func (a *attributes) addMap(r gjson.Result) {
+	r.ForEach(func(key, value gjson.Result) bool {
+		a.addValue(key.String(), value)
+		return true
+	})
+}
+
+// resultValue converts a JSON value to an attribute value.
+func resultValue(r gjson.Result) *commonv1.AnyValue {
+	switch r.Type {
+	case gjson.String:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: r.Str}}
+	case gjson.True, gjson.False:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_BoolValue{BoolValue: r.Bool()}}
+	case gjson.Number:
+		if !strings.ContainsAny(r.Raw, ".eE") {
+			return &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: r.Int()}}
+		}
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_DoubleValue{DoubleValue: r.Num}}
+	case gjson.JSON:
+		if r.IsArray() {
+			values := &commonv1.ArrayValue{}
+			for _, e := range r.Array() {
+				if v := resultValue(e); v != nil {
+					values.Values = append(values.Values, v)
+				}
+			}
+			return &commonv1.AnyValue{Value: &commonv1.AnyValue_ArrayValue{ArrayValue: values}}
+		}
+		var kvs attributes
+		kvs.addMap(r)
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_KvlistValue{KvlistValue: &commonv1.KeyValueList{Values: kvs}}}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func attributeValues(attrs []*commonv1.KeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(attrs))
+	for _, kv := range attrs {
+		m[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return m
+}
+
+func TestFromIntakeV2(t *testing.T) {
+	data := `{"metadata":{"service":{"name":"checkout","version":"1.2.3","environment":"prod","agent":{"name":"python","version":"6.0.0"}},"cloud":{"provider":"aws","region":"us-east-1"},"labels":{"team":"payments"}}}
+{"transaction":{"id":"0102030405060708","trace_id":"5b8efef142334f5a9d3b112c2f3d4e5f","name":"GET /cart","type":"request","result":"HTTP 2xx","timestamp":1700000000000000,"duration":250,"outcome":"success","faas":{"execution":"req-1","coldstart":true},"context":{"tags":{"cart_size":3}}}}
+{"span":{"id":"1112131415161718","parent_id":"0102030405060708","trace_id":"5b8efef142334f5a9d3b112c2f3d4e5f","name":"SELECT carts","type":"db","subtype":"postgresql","timestamp":1700000000010000,"duration":20,"outcome":"failure","context":{"db":{"statement":"SELECT * FROM carts"}}}}
+{"error":{"id":"9f0e1d2c3b4a59687766554433221100","trace_id":"5b8efef142334f5a9d3b112c2f3d4e5f","parent_id":"1112131415161718","timestamp":1700000000029000,"exception":{"message":"connection reset","type":"OperationalError"}}}
+{"metricset":{"timestamp":1700000000000000,"tags":{"env":"prod"},"samples":{"faas.duration":{"value":250},"requests":{"value":7,"type":"counter"},"transaction.duration.histogram":{"values":[10,100],"counts":[2,3],"type":"histogram"}}}}
+{"log":{"message":"cart is empty","@timestamp":1700000000000000,"log.level":"warn","trace.id":"5b8efef142334f5a9d3b112c2f3d4e5f","faas":{"execution":"req-1"}}}
+not json`
+
+	d, err := FromIntakeV2([]byte(data))
+	require.NoError(t, err)
+	require.NotNil(t, d.Traces)
+	require.NotNil(t, d.Metrics)
+	require.NotNil(t, d.Logs)
+
+	resource := attributeValues(d.Traces.ResourceSpans[0].Resource.Attributes)
+	assert.Equal(t, "checkout", resource["service.name"])
+	assert.Equal(t, "prod", resource["deployment.environment"])
+	assert.Equal(t, "python", resource["telemetry.sdk.name"])
+	assert.Equal(t, "us-east-1", resource["cloud.region"])
+	assert.Equal(t, "payments", resource["team"])
+
+	spans := d.Traces.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	tx := spans[0]
+	assert.Equal(t, testTraceID, tx.TraceId)
+	assert.Equal(t, testRootID, tx.SpanId)
+	assert.Empty(t, tx.ParentSpanId)
+	assert.Equal(t, tracev1.Span_SPAN_KIND_SERVER, tx.Kind)
+	assert.Equal(t, uint64(1_700_000_000_000_000_000), tx.StartTimeUnixNano)
+	assert.Equal(t, uint64(1_700_000_000_250_000_000), tx.EndTimeUnixNano)
+	assert.Equal(t, tracev1.Status_STATUS_CODE_OK, tx.Status.Code)
+	txAttrs := attributeValues(tx.Attributes)
+	assert.Equal(t, "req-1", txAttrs["faas.invocation_id"])
+	assert.Equal(t, true, txAttrs["faas.coldstart"])
+	assert.Equal(t, int64(3), txAttrs["cart_size"])
+
+	span := spans[1]
+	assert.Equal(t, testRootID, span.ParentSpanId)
+	assert.Equal(t, tracev1.Span_SPAN_KIND_CLIENT, span.Kind)
+	assert.Equal(t, tracev1.Status_STATUS_CODE_ERROR, span.Status.Code)
+	spanAttrs := attributeValues(span.Attributes)
+	assert.Equal(t, "postgresql", spanAttrs["db.system"])
+	assert.Equal(t, "SELECT * FROM carts", spanAttrs["db.statement"])
+
+	metrics := d.Metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 3)
+	assert.Equal(t, 250.0, metrics[0].GetGauge().DataPoints[0].GetAsDouble())
+	assert.Equal(t, map[string]interface{}{"env": "prod"}, attributeValues(metrics[0].GetGauge().DataPoints[0].Attributes))
+	assert.True(t, metrics[1].GetSum().IsMonotonic)
+	histogram := metrics[2].GetHistogram().DataPoints[0]
+	assert.Equal(t, []float64{10, 100}, histogram.ExplicitBounds)
+	assert.Equal(t, []uint64{2, 3, 0}, histogram.BucketCounts)
+	assert.Equal(t, uint64(5), histogram.Count)
+	assert.Equal(t, 320.0, histogram.GetSum())
+
+	records := d.Logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, records, 2)
+	assert.Equal(t, "connection reset", records[0].Body.GetStringValue())
+	assert.Equal(t, logsv1.SeverityNumber_SEVERITY_NUMBER_ERROR, records[0].SeverityNumber)
+	assert.Equal(t, testChildID, records[0].SpanId)
+	assert.Equal(t, "OperationalError", attributeValues(records[0].Attributes)["exception.type"])
+	assert.Equal(t, "cart is empty", records[1].Body.GetStringValue())
+	assert.Equal(t, logsv1.SeverityNumber_SEVERITY_NUMBER_WARN, records[1].SeverityNumber)
+	assert.Equal(t, testTraceID, records[1].TraceId)
+	assert.Equal(t, "req-1", attributeValues(records[1].Attributes)["faas.invocation_id"])
+}
+
+func TestFromIntakeV2Signals(t *testing.T) {
+	d, err := FromIntakeV2([]byte(`{"metadata":{"service":{"name":"checkout"}}}` + "\n" + `{"log":{"message":"test"}}`))
+	require.NoError(t, err)
+	assert.Nil(t, d.Traces)
+	assert.Nil(t, d.Metrics)
+	assert.NotNil(t, d.Logs)
+
+	_, err = FromIntakeV2([]byte(`{"log":{"message":"test"}}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"strings"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// ConvertLogs converts the body of an OTLP logs request to intake v2
+// payloads, one per resource. Log records are correlated with faas.
+func ConvertLogs(body []byte, enc Encoding, faas FAAS) ([][]byte, error) {
+	var ld logsv1.LogsData
+	if err := unmarshal(body, enc, &ld); err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	for _, rl := range ld.GetResourceLogs() {
+		var events [][]byte
+		for _, sl := range rl.GetScopeLogs() {
+			for _, record := range sl.GetLogRecords() {
+				event, err := marshalEvent("log", newLogLine(record, faas))
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, event)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		p, err := payload(rl.GetResource(), events)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// logLine is an intake v2 log event.
+type logLine struct {
+	Timestamp model.Time
+	Message   string
+	Level     string
+	TraceID   model.TraceID
+	SpanID    model.SpanID
+	Labels    model.IfaceMap
+	FAAS      *model.FAAS
+}
+
+func newLogLine(record *logsv1.LogRecord, faas FAAS) *logLine {
+	l := &logLine{
+		Message: stringValue(record.GetBody()),
+		Level:   strings.ToLower(record.GetSeverityText()),
+	}
+	ts := record.GetTimeUnixNano()
+	if ts == 0 {
+		ts = record.GetObservedTimeUnixNano()
+	}
+	l.Timestamp = timestamp(ts)
+	if l.Level == "" && record.GetSeverityNumber() != logsv1.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		// SEVERITY_NUMBER_INFO2 and the like are reported as "info".
+		level := strings.TrimPrefix(record.GetSeverityNumber().String(), "SEVERITY_NUMBER_")
+		l.Level = strings.ToLower(strings.TrimRight(level, "234"))
+	}
+	copy(l.TraceID[:], record.GetTraceId())
+	copy(l.SpanID[:], record.GetSpanId())
+
+	l.Labels = sortedLabels(attributeMap(record.GetAttributes()))
+	if faas != (FAAS{}) {
+		l.FAAS = &model.FAAS{ID: faas.ID, Execution: faas.Execution}
+	}
+	return l
+}
+
+func (l *logLine) MarshalFastJSON(w *fastjson.Writer) error {
+	var firstErr error
+	w.RawString(`{"message":`)
+	w.String(l.Message)
+	w.RawString(`,"@timestamp":`)
+	if err := l.Timestamp.MarshalFastJSON(w); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if l.Level != "" {
+		w.RawString(`,"log.level":`)
+		w.String(l.Level)
+	}
+	if l.TraceID != (model.TraceID{}) {
+		w.RawString(`,"trace.id":`)
+		if err := l.TraceID.MarshalFastJSON(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if l.SpanID != (model.SpanID{}) {
+		w.RawString(`,"span.id":`)
+		if err := l.SpanID.MarshalFastJSON(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(l.Labels) > 0 {
+		w.RawString(`,"labels":`)
+		if err := l.Labels.MarshalFastJSON(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if l.FAAS != nil {
+		w.RawString(`,"faas":{"id":`)
+		w.String(l.FAAS.ID)
+		w.RawString(`,"execution":`)
+		w.String(l.FAAS.Execution)
+		w.RawByte('}')
+	}
+	w.RawByte('}')
+	return firstErr
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestConvertLogs(t *testing.T) {
+	ld := &logsv1.LogsData{ResourceLogs: []*logsv1.ResourceLogs{{
+		Resource: testResource(),
+		ScopeLogs: []*logsv1.ScopeLogs{{LogRecords: []*logsv1.LogRecord{
+			{
+				TimeUnixNano: 1_700_000_000_000_000_000,
+				SeverityText: "WARN",
+				Body:         &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: "cart is empty"}},
+				Attributes:   []*commonv1.KeyValue{stringAttr("cart.id", "42")},
+				TraceId:      testTraceID,
+				SpanId:       testRootID,
+			},
+			{
+				ObservedTimeUnixNano: 1_700_000_001_000_000_000,
+				SeverityNumber:       logsv1.SeverityNumber_SEVERITY_NUMBER_ERROR3,
+				Body:                 &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: "checkout failed"}},
+			},
+		}}},
+	}}}
+	body, err := proto.Marshal(ld)
+	require.NoError(t, err)
+
+	payloads, err := ConvertLogs(body, Protobuf, FAAS{ID: "arn", Execution: "req-1"})
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	lines := bytes.Split(payloads[0], []byte("\n"))
+	require.Len(t, lines, 3)
+
+	l := gjson.ParseBytes(lines[1]).Get("log")
+	assert.Equal(t, "cart is empty", l.Get("message").String())
+	assert.Equal(t, int64(1_700_000_000_000_000), l.Get(`@timestamp`).Int())
+	assert.Equal(t, "warn", l.Get(`log\.level`).String())
+	assert.Equal(t, "5b8efef142334f5a9d3b112c2f3d4e5f", l.Get(`trace\.id`).String())
+	assert.Equal(t, "0102030405060708", l.Get(`span\.id`).String())
+	assert.Equal(t, "42", l.Get("labels.cart_id").String())
+	assert.Equal(t, "req-1", l.Get("faas.execution").String())
+
+	l = gjson.ParseBytes(lines[2]).Get("log")
+	assert.Equal(t, int64(1_700_000_001_000_000), l.Get(`@timestamp`).Int())
+	assert.Equal(t, "error", l.Get(`log\.level`).String())
+	assert.False(t, l.Get(`trace\.id`).Exists())
+}
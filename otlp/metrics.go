@@ -0,0 +1,222 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.elastic.co/apm/v2/model"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// ConvertMetrics converts the body of an OTLP metrics request to intake
+// v2 payloads, one per resource. Data points sharing the same timestamp
+// and attributes are grouped in a single metricset, which is correlated
+// with faas.
+func ConvertMetrics(body []byte, enc Encoding, faas FAAS) ([][]byte, error) {
+	var md metricsv1.MetricsData
+	if err := unmarshal(body, enc, &md); err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	for _, rm := range md.GetResourceMetrics() {
+		ms := metricsets{faas: faas}
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				ms.addMetric(m)
+			}
+		}
+		if len(ms.order) == 0 {
+			continue
+		}
+
+		events := make([][]byte, 0, len(ms.order))
+		for _, m := range ms.order {
+			event, err := marshalEvent("metricset", m)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		p, err := payload(rm.GetResource(), events)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// metricsets groups data points in metricsets by timestamp and attributes.
+type metricsets struct {
+	faas  FAAS
+	byKey map[string]*model.Metrics
+	order []*model.Metrics
+}
+
+func (ms *metricsets) addMetric(m *metricsv1.Metric) {
+	name := m.GetName()
+	switch data := m.GetData().(type) {
+	case *metricsv1.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name, model.Metric{Type: "gauge", Value: numberValue(dp)})
+		}
+	case *metricsv1.Metric_Sum:
+		typ := "gauge"
+		if data.Sum.GetIsMonotonic() {
+			typ = "counter"
+		}
+		for _, dp := range data.Sum.GetDataPoints() {
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name, model.Metric{Type: typ, Value: numberValue(dp)})
+		}
+	case *metricsv1.Metric_Histogram:
+		for _, dp := range data.Histogram.GetDataPoints() {
+			values, counts := histogramBuckets(dp.GetExplicitBounds(), dp.GetBucketCounts())
+			if len(counts) == 0 {
+				continue
+			}
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name, model.Metric{Type: "histogram", Values: values, Counts: counts})
+		}
+	case *metricsv1.Metric_ExponentialHistogram:
+		for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+			values, counts := exponentialHistogramBuckets(dp)
+			if len(counts) == 0 {
+				continue
+			}
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name, model.Metric{Type: "histogram", Values: values, Counts: counts})
+		}
+	case *metricsv1.Metric_Summary:
+		// Quantiles can't be aggregated, only the count and sum are kept.
+		for _, dp := range data.Summary.GetDataPoints() {
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name+".count", model.Metric{Type: "counter", Value: float64(dp.GetCount())})
+			ms.add(dp.GetTimeUnixNano(), dp.GetAttributes(), name+".sum", model.Metric{Type: "counter", Value: dp.GetSum()})
+		}
+	}
+}
+
+func (ms *metricsets) add(timeUnixNano uint64, attrs []*commonv1.KeyValue, name string, sample model.Metric) {
+	labels := make(model.StringMap, 0, len(attrs))
+	for _, kv := range attrs {
+		labels = append(labels, model.StringMapItem{Key: LabelKey(kv.GetKey()), Value: stringValue(kv.GetValue())})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+
+	var key strings.Builder
+	key.WriteString(strconv.FormatUint(timeUnixNano, 10))
+	for _, l := range labels {
+		key.WriteString("\x00" + l.Key + "\x00" + l.Value)
+	}
+
+	m, ok := ms.byKey[key.String()]
+	if !ok {
+		m = &model.Metrics{
+			Timestamp: timestamp(timeUnixNano),
+			Samples:   make(map[string]model.Metric),
+		}
+		if len(labels) > 0 {
+			m.Labels = labels
+		}
+		if ms.faas != (FAAS{}) {
+			m.FAAS = &model.FAAS{ID: ms.faas.ID, Execution: ms.faas.Execution}
+		}
+		if ms.byKey == nil {
+			ms.byKey = make(map[string]*model.Metrics)
+		}
+		ms.byKey[key.String()] = m
+		ms.order = append(ms.order, m)
+	}
+	m.Samples[name] = sample
+}
+
+func numberValue(dp *metricsv1.NumberDataPoint) float64 {
+	if v, ok := dp.GetValue().(*metricsv1.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return dp.GetAsDouble()
+}
+
+// histogramBuckets converts explicit bucket bounds to the midpoints of
+// the buckets, skipping the empty ones. The unbounded buckets are
+// represented by their single bound.
+func histogramBuckets(bounds []float64, bucketCounts []uint64) ([]float64, []uint64) {
+	var (
+		values []float64
+		counts []uint64
+	)
+	for i, count := range bucketCounts {
+		if count == 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case len(bounds) == 0:
+			value = 0
+		case i == 0:
+			value = bounds[0]
+			if value > 0 {
+				value /= 2
+			}
+		case i >= len(bounds):
+			value = bounds[len(bounds)-1]
+		default:
+			value = bounds[i-1] + (bounds[i]-bounds[i-1])/2
+		}
+		values = append(values, value)
+		counts = append(counts, count)
+	}
+	return values, counts
+}
+
+// exponentialHistogramBuckets converts the buckets of an exponential
+// histogram to their midpoints, in ascending order.
+func exponentialHistogramBuckets(dp *metricsv1.ExponentialHistogramDataPoint) ([]float64, []uint64) {
+	base := math.Pow(2, math.Pow(2, -float64(dp.GetScale())))
+	midpoint := func(index int) float64 {
+		lower := math.Pow(base, float64(index))
+		return (lower + lower*base) / 2
+	}
+
+	var (
+		values []float64
+		counts []uint64
+	)
+	negative := dp.GetNegative()
+	for i := len(negative.GetBucketCounts()) - 1; i >= 0; i-- {
+		if count := negative.GetBucketCounts()[i]; count > 0 {
+			values = append(values, -midpoint(int(negative.GetOffset())+i))
+			counts = append(counts, count)
+		}
+	}
+	if count := dp.GetZeroCount(); count > 0 {
+		values = append(values, 0)
+		counts = append(counts, count)
+	}
+	positive := dp.GetPositive()
+	for i, count := range positive.GetBucketCounts() {
+		if count > 0 {
+			values = append(values, midpoint(int(positive.GetOffset())+i))
+			counts = append(counts, count)
+		}
+	}
+	return values, counts
+}
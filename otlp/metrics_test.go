@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestConvertMetrics(t *testing.T) {
+	const ts = 1_700_000_000_000_000_000
+	attrs := []*commonv1.KeyValue{stringAttr("http.route", "/cart")}
+	md := &metricsv1.MetricsData{ResourceMetrics: []*metricsv1.ResourceMetrics{{
+		Resource: testResource(),
+		ScopeMetrics: []*metricsv1.ScopeMetrics{{Metrics: []*metricsv1.Metric{
+			{
+				Name: "requests",
+				Data: &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+					IsMonotonic: true,
+					DataPoints: []*metricsv1.NumberDataPoint{{
+						TimeUnixNano: ts,
+						Attributes:   attrs,
+						Value:        &metricsv1.NumberDataPoint_AsInt{AsInt: 42},
+					}},
+				}},
+			},
+			{
+				Name: "latency",
+				Data: &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+					DataPoints: []*metricsv1.HistogramDataPoint{{
+						TimeUnixNano:   ts,
+						Attributes:     attrs,
+						ExplicitBounds: []float64{10, 100},
+						BucketCounts:   []uint64{1, 0, 3},
+					}},
+				}},
+			},
+			{
+				Name: "memory",
+				Data: &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{
+					DataPoints: []*metricsv1.NumberDataPoint{{
+						TimeUnixNano: ts,
+						Value:        &metricsv1.NumberDataPoint_AsDouble{AsDouble: 0.5},
+					}},
+				}},
+			},
+		}}},
+	}}}
+	body, err := proto.Marshal(md)
+	require.NoError(t, err)
+
+	payloads, err := ConvertMetrics(body, Protobuf, FAAS{ID: "arn", Execution: "req-1"})
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	// The data points with the same attributes share a metricset.
+	lines := bytes.Split(payloads[0], []byte("\n"))
+	require.Len(t, lines, 3)
+
+	ms := gjson.ParseBytes(lines[1]).Get("metricset")
+	assert.Equal(t, int64(1_700_000_000_000_000), ms.Get("timestamp").Int())
+	assert.Equal(t, "/cart", ms.Get("tags.http_route").String())
+	assert.Equal(t, "req-1", ms.Get("faas.execution").String())
+	assert.Equal(t, float64(42), ms.Get("samples.requests.value").Float())
+	assert.Equal(t, "counter", ms.Get("samples.requests.type").String())
+	assert.Equal(t, "histogram", ms.Get("samples.latency.type").String())
+	assert.JSONEq(t, "[5,100]", ms.Get("samples.latency.values").Raw)
+	assert.JSONEq(t, "[1,3]", ms.Get("samples.latency.counts").Raw)
+
+	ms = gjson.ParseBytes(lines[2]).Get("metricset")
+	assert.False(t, ms.Get("tags").Exists())
+	assert.Equal(t, 0.5, ms.Get("samples.memory.value").Float())
+	assert.Equal(t, "gauge", ms.Get("samples.memory.type").String())
+}
+
+func TestExponentialHistogramBuckets(t *testing.T) {
+	values, counts := exponentialHistogramBuckets(&metricsv1.ExponentialHistogramDataPoint{
+		Scale:     0,
+		ZeroCount: 1,
+		Positive:  &metricsv1.ExponentialHistogramDataPoint_Buckets{Offset: 1, BucketCounts: []uint64{2, 0, 4}},
+		Negative:  &metricsv1.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{5}},
+	})
+	assert.Equal(t, []float64{-1.5, 0, 3, 12}, values)
+	assert.Equal(t, []uint64{5, 1, 2, 4}, counts)
+}
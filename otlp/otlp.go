@@ -0,0 +1,337 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package otlp converts OpenTelemetry data received over OTLP/HTTP to
+// APM Server intake v2 events.
+package otlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Encoding is the encoding of an OTLP/HTTP request body.
+type Encoding int
+
+const (
+	// Protobuf is the binary protobuf encoding, with the
+	// application/x-protobuf content type.
+	Protobuf Encoding = iota
+	// JSON is the JSON protobuf encoding, with the application/json
+	// content type.
+	JSON
+)
+
+// FAAS identifies the function invocation that OTLP data is correlated
+// with when the data doesn't carry it.
+type FAAS struct {
+	// ID is the ARN of the function.
+	ID string
+	// Execution is the request ID of the invocation.
+	Execution string
+}
+
+// unmarshal decodes an OTLP request body into m.
+func unmarshal(body []byte, enc Encoding, m proto.Message) error {
+	if enc == Protobuf {
+		if err := proto.Unmarshal(body, m); err != nil {
+			return fmt.Errorf("failed to unmarshal protobuf: %w", err)
+		}
+		return nil
+	}
+
+	body, err := hexIDsToBase64(body)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal json: %w", err)
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(body, m); err != nil {
+		return fmt.Errorf("failed to unmarshal json: %w", err)
+	}
+	return nil
+}
+
+// hexIDsToBase64 rewrites the trace and span IDs of an OTLP/JSON body,
+// which are hex encoded as mandated by the specification, to the base64
+// encoding expected for bytes fields by the protobuf JSON mapping.
+func hexIDsToBase64(body []byte) ([]byte, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	rewriteIDs(v)
+	return json.Marshal(v)
+}
+
+func rewriteIDs(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			switch k {
+			case "traceId", "trace_id", "spanId", "span_id", "parentSpanId", "parent_span_id":
+				if s, ok := e.(string); ok {
+					if b, err := hex.DecodeString(s); err == nil {
+						v[k] = base64.StdEncoding.EncodeToString(b)
+					}
+				}
+			default:
+				rewriteIDs(e)
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			rewriteIDs(e)
+		}
+	}
+}
+
+// metadata is the intake v2 metadata of the events of a resource.
+type metadata struct {
+	Service model.Service
+	Cloud   *model.Cloud
+	Labels  model.IfaceMap
+}
+
+func (m *metadata) MarshalFastJSON(w *fastjson.Writer) error {
+	var firstErr error
+	w.RawString(`{"service":`)
+	if err := m.Service.MarshalFastJSON(w); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if m.Cloud != nil {
+		w.RawString(`,"cloud":`)
+		if err := m.Cloud.MarshalFastJSON(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(m.Labels) > 0 {
+		w.RawString(`,"labels":`)
+		if err := m.Labels.MarshalFastJSON(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	w.RawByte('}')
+	return firstErr
+}
+
+// resourceMetadata maps the semantic conventions of the resource
+// attributes to the intake v2 metadata. Other attributes become global
+// labels.
+func resourceMetadata(resource *resourcev1.Resource) *metadata {
+	md := &metadata{
+		Service: model.Service{
+			Name:  "unknown",
+			Agent: &model.Agent{Name: "opentelemetry", Version: "unknown"},
+		},
+	}
+	var cloud model.Cloud
+	labels := make(map[string]*commonv1.AnyValue)
+	for k, v := range attributeMap(resource.GetAttributes()) {
+		s := stringValue(v)
+		switch k {
+		case "service.name":
+			md.Service.Name = s
+		case "service.version":
+			md.Service.Version = s
+		case "deployment.environment":
+			md.Service.Environment = s
+		case "service.instance.id":
+			md.Service.Node = &model.ServiceNode{ConfiguredName: s}
+		case "telemetry.sdk.language":
+			md.Service.Language = &model.Language{Name: s}
+			md.Service.Agent.Name = "opentelemetry/" + s
+		case "telemetry.sdk.version":
+			md.Service.Agent.Version = s
+		case "telemetry.sdk.name":
+		case "cloud.provider":
+			cloud.Provider = s
+		case "cloud.region":
+			cloud.Region = s
+		case "cloud.account.id":
+			cloud.Account = &model.CloudAccount{ID: s}
+		default:
+			labels[k] = v
+		}
+	}
+	if cloud.Provider != "" {
+		md.Cloud = &cloud
+	}
+	md.Labels = sortedLabels(labels)
+	return md
+}
+
+// payload joins the metadata of a resource and its events in the intake
+// v2 ndjson format.
+func payload(resource *resourcev1.Resource, events [][]byte) ([]byte, error) {
+	md, err := marshalEvent("metadata", resourceMetadata(resource))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(append([][]byte{md}, events...), []byte("\n")), nil
+}
+
+// event wraps an intake v2 event in an object keyed by the event type.
+type event struct {
+	kind  string
+	value fastjson.Marshaler
+}
+
+func (e event) MarshalFastJSON(w *fastjson.Writer) error {
+	w.RawString(`{"`)
+	w.RawString(e.kind)
+	w.RawString(`":`)
+	err := e.value.MarshalFastJSON(w)
+	w.RawByte('}')
+	return err
+}
+
+func marshalEvent(kind string, value fastjson.Marshaler) ([]byte, error) {
+	var w fastjson.Writer
+	if err := (event{kind: kind, value: value}).MarshalFastJSON(&w); err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", kind, err)
+	}
+	return w.Bytes(), nil
+}
+
+func attributeMap(attrs []*commonv1.KeyValue) map[string]*commonv1.AnyValue {
+	m := make(map[string]*commonv1.AnyValue, len(attrs))
+	for _, kv := range attrs {
+		m[kv.GetKey()] = kv.GetValue()
+	}
+	return m
+}
+
+// sortedLabels converts attributes to intake v2 labels, sorted by key.
+func sortedLabels(attrs map[string]*commonv1.AnyValue) model.IfaceMap {
+	if len(attrs) == 0 {
+		return nil
+	}
+	labels := make(model.IfaceMap, 0, len(attrs))
+	for k, v := range attrs {
+		labels = append(labels, model.IfaceMapItem{Key: LabelKey(k), Value: labelValue(v)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return labels
+}
+
+// otelAttributes converts attributes to the otel.attributes of intake
+// v2 events, which APM Server maps according to the semantic conventions.
+func otelAttributes(attrs []*commonv1.KeyValue) map[string]interface{} {
+	if len(attrs) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(attrs))
+	for _, kv := range attrs {
+		m[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return m
+}
+
+var labelKeyReplacer = strings.NewReplacer(".", "_", "*", "_", `"`, "_")
+
+// LabelKey replaces the characters that are not allowed in label keys.
+func LabelKey(k string) string {
+	return labelKeyReplacer.Replace(k)
+}
+
+// labelValue returns the value of an attribute as a string, number or
+// boolean, the only types allowed for labels.
+func labelValue(v *commonv1.AnyValue) interface{} {
+	switch value := v.GetValue().(type) {
+	case *commonv1.AnyValue_BoolValue:
+		return value.BoolValue
+	case *commonv1.AnyValue_IntValue:
+		return value.IntValue
+	case *commonv1.AnyValue_DoubleValue:
+		return value.DoubleValue
+	default:
+		return stringValue(v)
+	}
+}
+
+// stringValue returns the string representation of an attribute value.
+func stringValue(v *commonv1.AnyValue) string {
+	switch value := v.GetValue().(type) {
+	case nil:
+		return ""
+	case *commonv1.AnyValue_StringValue:
+		return value.StringValue
+	case *commonv1.AnyValue_BoolValue:
+		return fmt.Sprint(value.BoolValue)
+	case *commonv1.AnyValue_IntValue:
+		return fmt.Sprint(value.IntValue)
+	case *commonv1.AnyValue_DoubleValue:
+		return fmt.Sprint(value.DoubleValue)
+	case *commonv1.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	default:
+		b, err := json.Marshal(anyValue(v))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// anyValue converts an attribute value to its natural Go representation.
+func anyValue(v *commonv1.AnyValue) interface{} {
+	switch v := v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		return v.StringValue
+	case *commonv1.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonv1.AnyValue_IntValue:
+		return v.IntValue
+	case *commonv1.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonv1.AnyValue_BytesValue:
+		return v.BytesValue
+	case *commonv1.AnyValue_ArrayValue:
+		values := make([]interface{}, 0, len(v.ArrayValue.GetValues()))
+		for _, e := range v.ArrayValue.GetValues() {
+			values = append(values, anyValue(e))
+		}
+		return values
+	case *commonv1.AnyValue_KvlistValue:
+		values := make(map[string]interface{}, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			values[kv.GetKey()] = anyValue(kv.GetValue())
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// timestamp converts a timestamp in nanoseconds since the epoch.
+func timestamp(unixNano uint64) model.Time {
+	return model.Time(time.Unix(0, int64(unixNano)).UTC())
+}
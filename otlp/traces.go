@@ -0,0 +1,262 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// ConvertTraces converts the body of an OTLP traces request to intake
+// v2 payloads, one per resource. Root and entry spans become
+// transactions, other spans become spans and exception span events
+// become errors. Transactions that don't carry the invocation they
+// belong to are correlated with faas.
+func ConvertTraces(body []byte, enc Encoding, faas FAAS) ([][]byte, error) {
+	var td tracev1.TracesData
+	if err := unmarshal(body, enc, &td); err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	for _, rs := range td.GetResourceSpans() {
+		var events [][]byte
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				spanEvents, err := convertSpan(span, faas)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, spanEvents...)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		p, err := payload(rs.GetResource(), events)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+func convertSpan(span *tracev1.Span, faas FAAS) ([][]byte, error) {
+	attrs := attributeMap(span.GetAttributes())
+	otel := &model.OTel{
+		SpanKind:   strings.TrimPrefix(span.GetKind().String(), "SPAN_KIND_"),
+		Attributes: otelAttributes(span.GetAttributes()),
+	}
+
+	var (
+		traceID  model.TraceID
+		id       model.SpanID
+		parentID model.SpanID
+	)
+	copy(traceID[:], span.GetTraceId())
+	copy(id[:], span.GetSpanId())
+	copy(parentID[:], span.GetParentSpanId())
+
+	var (
+		event         []byte
+		err           error
+		transactionID model.SpanID
+	)
+	if isTransaction(span) {
+		transactionID = id
+		txType := transactionType(span, attrs)
+		event, err = marshalEvent("transaction", &model.Transaction{
+			ID:        id,
+			TraceID:   traceID,
+			ParentID:  parentID,
+			Name:      span.GetName(),
+			Type:      txType,
+			Timestamp: timestamp(span.GetStartTimeUnixNano()),
+			Duration:  durationMillis(span),
+			Result:    transactionResult(attrs),
+			Outcome:   outcome(span, attrs, 500),
+			OTel:      otel,
+			FAAS:      faasContext(attrs, faas),
+		})
+	} else {
+		spanType, subtype := spanType(span, attrs)
+		event, err = marshalEvent("span", &model.Span{
+			ID:        id,
+			TraceID:   traceID,
+			ParentID:  parentID,
+			Name:      span.GetName(),
+			Type:      spanType,
+			Subtype:   subtype,
+			Timestamp: timestamp(span.GetStartTimeUnixNano()),
+			Duration:  durationMillis(span),
+			Outcome:   outcome(span, attrs, 400),
+			OTel:      otel,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := [][]byte{event}
+	for _, e := range span.GetEvents() {
+		if e.GetName() != "exception" {
+			continue
+		}
+		eventAttrs := attributeMap(e.GetAttributes())
+		exception := model.Exception{
+			Message: stringValue(eventAttrs["exception.message"]),
+			Type:    stringValue(eventAttrs["exception.type"]),
+			Handled: !eventAttrs["exception.escaped"].GetBoolValue(),
+		}
+		if exception.Message == "" && exception.Type == "" {
+			continue
+		}
+		var errorID model.TraceID
+		if _, err := rand.Read(errorID[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate error id: %w", err)
+		}
+		event, err := marshalEvent("error", &model.Error{
+			ID:            errorID,
+			TraceID:       traceID,
+			ParentID:      id,
+			TransactionID: transactionID,
+			Timestamp:     timestamp(e.GetTimeUnixNano()),
+			Exception:     exception,
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// isTransaction returns whether the span is the root of a trace or the
+// entry point of a service, as opposed to a span within a transaction.
+func isTransaction(span *tracev1.Span) bool {
+	switch span.GetKind() {
+	case tracev1.Span_SPAN_KIND_SERVER, tracev1.Span_SPAN_KIND_CONSUMER:
+		return true
+	}
+	return len(span.GetParentSpanId()) == 0
+}
+
+func transactionType(span *tracev1.Span, attrs map[string]*commonv1.AnyValue) string {
+	if span.GetKind() == tracev1.Span_SPAN_KIND_CONSUMER || stringValue(attrs["faas.trigger"]) == "pubsub" {
+		return "messaging"
+	}
+	if span.GetKind() == tracev1.Span_SPAN_KIND_SERVER {
+		return "request"
+	}
+	return "unknown"
+}
+
+// transactionResult returns the result of HTTP transactions, in the
+// form "HTTP 2xx".
+func transactionResult(attrs map[string]*commonv1.AnyValue) string {
+	status := httpStatusCode(attrs)
+	if status <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("HTTP %dxx", status/100)
+}
+
+func spanType(span *tracev1.Span, attrs map[string]*commonv1.AnyValue) (string, string) {
+	switch {
+	case attrs["db.system"] != nil:
+		return "db", stringValue(attrs["db.system"])
+	case attrs["messaging.system"] != nil:
+		return "messaging", stringValue(attrs["messaging.system"])
+	case attrs["rpc.system"] != nil:
+		return "external", stringValue(attrs["rpc.system"])
+	case attrs["http.method"] != nil, attrs["http.request.method"] != nil:
+		return "external", "http"
+	case span.GetKind() == tracev1.Span_SPAN_KIND_CLIENT, span.GetKind() == tracev1.Span_SPAN_KIND_PRODUCER:
+		return "external", ""
+	}
+	return "app", "internal"
+}
+
+// outcome derives the outcome from the span status or, if it's unset,
+// from the HTTP status code compared to the first failing status.
+func outcome(span *tracev1.Span, attrs map[string]*commonv1.AnyValue, failingStatus int64) string {
+	switch span.GetStatus().GetCode() {
+	case tracev1.Status_STATUS_CODE_ERROR:
+		return "failure"
+	case tracev1.Status_STATUS_CODE_OK:
+		return "success"
+	}
+	if httpStatusCode(attrs) >= failingStatus {
+		return "failure"
+	}
+	return "success"
+}
+
+func httpStatusCode(attrs map[string]*commonv1.AnyValue) int64 {
+	for _, k := range []string{"http.response.status_code", "http.status_code"} {
+		if v, ok := attrs[k]; ok {
+			return v.GetIntValue()
+		}
+	}
+	return 0
+}
+
+// faasContext returns the faas context of a transaction from its
+// attributes, falling back to the current invocation.
+func faasContext(attrs map[string]*commonv1.AnyValue, faas FAAS) *model.FAAS {
+	execution := stringValue(attrs["faas.invocation_id"])
+	if execution == "" {
+		execution = stringValue(attrs["faas.execution"])
+	}
+	id := stringValue(attrs["cloud.resource_id"])
+	if id == "" {
+		id = stringValue(attrs["faas.id"])
+	}
+	if execution == "" && id == "" {
+		execution, id = faas.Execution, faas.ID
+	}
+	if execution == "" && id == "" {
+		return nil
+	}
+	f := &model.FAAS{
+		ID:        id,
+		Execution: execution,
+		Name:      stringValue(attrs["faas.name"]),
+		Version:   stringValue(attrs["faas.version"]),
+		Coldstart: attrs["faas.coldstart"].GetBoolValue(),
+	}
+	if trigger := stringValue(attrs["faas.trigger"]); trigger != "" {
+		f.Trigger = &model.FAASTrigger{Type: trigger}
+	}
+	return f
+}
+
+func durationMillis(span *tracev1.Span) float64 {
+	start, end := span.GetStartTimeUnixNano(), span.GetEndTimeUnixNano()
+	if end < start {
+		return 0
+	}
+	return float64(end-start) / float64(time.Millisecond)
+}
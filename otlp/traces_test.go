@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	testTraceID = []byte{0x5b, 0x8e, 0xfe, 0xf1, 0x42, 0x33, 0x4f, 0x5a, 0x9d, 0x3b, 0x11, 0x2c, 0x2f, 0x3d, 0x4e, 0x5f}
+	testRootID  = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	testChildID = []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+)
+
+func stringAttr(k, v string) *commonv1.KeyValue {
+	return &commonv1.KeyValue{Key: k, Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: v}}}
+}
+
+func intAttr(k string, v int64) *commonv1.KeyValue {
+	return &commonv1.KeyValue{Key: k, Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: v}}}
+}
+
+func testResource() *resourcev1.Resource {
+	return &resourcev1.Resource{Attributes: []*commonv1.KeyValue{
+		stringAttr("service.name", "checkout"),
+		stringAttr("service.version", "1.2.3"),
+		stringAttr("telemetry.sdk.language", "python"),
+		stringAttr("telemetry.sdk.version", "1.20.0"),
+		stringAttr("cloud.provider", "aws"),
+		stringAttr("cloud.region", "us-east-1"),
+		stringAttr("team", "payments"),
+	}}
+}
+
+func testTraces() *tracev1.TracesData {
+	return &tracev1.TracesData{ResourceSpans: []*tracev1.ResourceSpans{{
+		Resource: testResource(),
+		ScopeSpans: []*tracev1.ScopeSpans{{Spans: []*tracev1.Span{
+			{
+				TraceId:           testTraceID,
+				SpanId:            testRootID,
+				Name:              "GET /cart",
+				Kind:              tracev1.Span_SPAN_KIND_SERVER,
+				StartTimeUnixNano: 1_700_000_000_000_000_000,
+				EndTimeUnixNano:   1_700_000_000_250_000_000,
+				Attributes:        []*commonv1.KeyValue{intAttr("http.status_code", 503)},
+			},
+			{
+				TraceId:           testTraceID,
+				SpanId:            testChildID,
+				ParentSpanId:      testRootID,
+				Name:              "SELECT carts",
+				Kind:              tracev1.Span_SPAN_KIND_CLIENT,
+				StartTimeUnixNano: 1_700_000_000_010_000_000,
+				EndTimeUnixNano:   1_700_000_000_030_000_000,
+				Attributes:        []*commonv1.KeyValue{stringAttr("db.system", "postgresql")},
+				Status:            &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR},
+				Events: []*tracev1.Span_Event{{
+					Name:         "exception",
+					TimeUnixNano: 1_700_000_000_029_000_000,
+					Attributes: []*commonv1.KeyValue{
+						stringAttr("exception.type", "OperationalError"),
+						stringAttr("exception.message", "connection reset"),
+					},
+				}},
+			},
+		}}},
+	}}}
+}
+
+func TestConvertTraces(t *testing.T) {
+	body, err := proto.Marshal(testTraces())
+	require.NoError(t, err)
+
+	payloads, err := ConvertTraces(body, Protobuf, FAAS{ID: "arn:aws:lambda:us-east-1:123456789012:function:checkout", Execution: "req-1"})
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	lines := bytes.Split(payloads[0], []byte("\n"))
+	require.Len(t, lines, 4)
+
+	md := gjson.ParseBytes(lines[0])
+	assert.Equal(t, "checkout", md.Get("metadata.service.name").String())
+	assert.Equal(t, "1.2.3", md.Get("metadata.service.version").String())
+	assert.Equal(t, "opentelemetry/python", md.Get("metadata.service.agent.name").String())
+	assert.Equal(t, "1.20.0", md.Get("metadata.service.agent.version").String())
+	assert.Equal(t, "us-east-1", md.Get("metadata.cloud.region").String())
+	assert.Equal(t, "payments", md.Get("metadata.labels.team").String())
+
+	tx := gjson.ParseBytes(lines[1]).Get("transaction")
+	assert.Equal(t, "0102030405060708", tx.Get("id").String())
+	assert.Equal(t, "5b8efef142334f5a9d3b112c2f3d4e5f", tx.Get("trace_id").String())
+	assert.Equal(t, "request", tx.Get("type").String())
+	assert.Equal(t, "HTTP 5xx", tx.Get("result").String())
+	assert.Equal(t, "failure", tx.Get("outcome").String())
+	assert.Equal(t, int64(1_700_000_000_000_000), tx.Get("timestamp").Int())
+	assert.Equal(t, float64(250), tx.Get("duration").Float())
+	assert.Equal(t, "req-1", tx.Get("faas.execution").String())
+	assert.Equal(t, "SERVER", tx.Get("otel.span_kind").String())
+
+	span := gjson.ParseBytes(lines[2]).Get("span")
+	assert.Equal(t, "1112131415161718", span.Get("id").String())
+	assert.Equal(t, "0102030405060708", span.Get("parent_id").String())
+	assert.Equal(t, "db", span.Get("type").String())
+	assert.Equal(t, "postgresql", span.Get("subtype").String())
+	assert.Equal(t, "failure", span.Get("outcome").String())
+	assert.Equal(t, float64(20), span.Get("duration").Float())
+
+	e := gjson.ParseBytes(lines[3]).Get("error")
+	assert.Equal(t, "1112131415161718", e.Get("parent_id").String())
+	assert.Equal(t, "connection reset", e.Get("exception.message").String())
+	assert.Equal(t, "OperationalError", e.Get("exception.type").String())
+}
+
+func TestConvertTracesJSON(t *testing.T) {
+	body := []byte(`{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},` +
+		`"scopeSpans":[{"spans":[{"traceId":"5b8efef142334f5a9d3b112c2f3d4e5f","spanId":"0102030405060708",` +
+		`"name":"handler","kind":2,"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000100000000",` +
+		`"attributes":[{"key":"faas.invocation_id","value":{"stringValue":"req-2"}}],"unknownField":true}]}]}]}`)
+
+	payloads, err := ConvertTraces(body, JSON, FAAS{Execution: "req-1"})
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	lines := bytes.Split(payloads[0], []byte("\n"))
+	require.Len(t, lines, 2)
+	tx := gjson.ParseBytes(lines[1]).Get("transaction")
+	assert.Equal(t, "0102030405060708", tx.Get("id").String())
+	assert.Equal(t, "5b8efef142334f5a9d3b112c2f3d4e5f", tx.Get("trace_id").String())
+	assert.Equal(t, float64(100), tx.Get("duration").Float())
+	assert.Equal(t, "req-2", tx.Get("faas.execution").String())
+}
+
+func TestConvertTracesInvalid(t *testing.T) {
+	_, err := ConvertTraces([]byte("not json"), JSON, FAAS{})
+	assert.Error(t, err)
+	_, err = ConvertTraces([]byte{0xff, 0xff}, Protobuf, FAAS{})
+	assert.Error(t, err)
+}